@@ -0,0 +1,31 @@
+// Command scim-stub runs an in-memory SCIM 2.0 server for local testing of
+// the SCIM push (SCIM_BASE_URL=http://localhost:9090/scim2). Data is lost on
+// exit and requests are not authenticated.
+package main
+
+import (
+    "log"
+    "net/http"
+    "os"
+
+    "smart-transit-system/internal/scim/scimtest"
+)
+
+func main() {
+    addr := os.Getenv("SCIM_STUB_ADDR")
+    if addr == "" {
+        addr = ":9090"
+    }
+    stub := scimtest.NewStub()
+    mux := http.NewServeMux()
+    mux.Handle("/scim2/", http.StripPrefix("/scim2", logRequests(stub)))
+    log.Printf("SCIM stub listening on %s (base URL http://localhost%s/scim2)", addr, addr)
+    log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+func logRequests(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("%s %s", r.Method, r.URL.RequestURI())
+        h.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,28 @@
+package audit
+
+import (
+    "encoding/json"
+    "log"
+
+    "gorm.io/gorm"
+
+    "smart-transit-system/internal/models"
+)
+
+// Write records a user_audits row with details encoded as JSON. Failures are
+// logged rather than returned so auditing never breaks the request path.
+// actorID may be empty for system-initiated changes.
+func Write(db *gorm.DB, userID, actorID, action string, details any) {
+    b, _ := json.Marshal(details)
+    row := models.UserAudit{UserID: userID, ActorID: actorID, Action: action, Details: string(b)}
+    q := db
+    if userID == "" {
+        q = q.Omit("UserID")
+    }
+    if actorID == "" {
+        q = q.Omit("ActorID")
+    }
+    if err := q.Create(&row).Error; err != nil {
+        log.Printf("WARN: audit %s for %s failed: %v", action, userID, err)
+    }
+}
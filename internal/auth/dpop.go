@@ -0,0 +1,355 @@
+package auth
+
+import (
+    "container/heap"
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    jwt "github.com/golang-jwt/jwt/v4"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+
+    "smart-transit-system/internal/models"
+)
+
+// DPoP (RFC 9449) failures.
+var (
+    ErrDPoPProof    = errors.New("invalid DPoP proof")
+    ErrDPoPReplay   = errors.New("DPoP proof replayed")
+    ErrDPoPBinding  = errors.New("DPoP key does not match token binding")
+    ErrTokenIsBound = errors.New("sender-constrained token presented without proof")
+)
+
+// dpopAlgs are the proof signature algorithms accepted (asymmetric only).
+var dpopAlgs = []string{"ES256", "ES384", "ES512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "EdDSA"}
+
+// minRSAKeyBits is the smallest RSA proof key accepted.
+const minRSAKeyBits = 2048
+
+// DPoPConfig configures DPoP proof validation.
+type DPoPConfig struct {
+    // PublicBaseURL is the external scheme://host[:port] clients use; htu
+    // is checked against it. Required: deriving it from Host or
+    // X-Forwarded-* headers would let a caller choose the URL it is
+    // checked against.
+    PublicBaseURL string
+    MaxAge        time.Duration // how old a proof's iat may be; defaults to 5m
+    Replay        ReplayCache   // defaults to an in-memory cache of 100000 entries
+}
+
+// ReplayCache remembers proof identifiers until they expire.
+type ReplayCache interface {
+    // Seen records key and reports whether it was already present.
+    Seen(ctx context.Context, key string, expires time.Time) (bool, error)
+}
+
+// DPoP validates DPoP proofs for sender-constrained access tokens.
+type DPoP struct {
+    auth *Auth
+    cfg  DPoPConfig
+}
+
+// UseDPoP enables "Authorization: DPoP" tokens. Tokens carrying cnf.jkt are
+// then only accepted with a matching proof.
+func (a *Auth) UseDPoP(cfg DPoPConfig) error {
+    cfg.PublicBaseURL = strings.TrimRight(cfg.PublicBaseURL, "/")
+    u, err := url.Parse(cfg.PublicBaseURL)
+    if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Path != "" {
+        return fmt.Errorf("dpop: public base URL %q must be scheme://host[:port]", cfg.PublicBaseURL)
+    }
+    if cfg.MaxAge <= 0 {
+        cfg.MaxAge = 5 * time.Minute
+    }
+    if cfg.Replay == nil {
+        cfg.Replay = NewMemoryReplayCache(100000)
+    }
+    a.dpop = &DPoP{auth: a, cfg: cfg}
+    return nil
+}
+
+// confirmationJKT returns the cnf.jkt thumbprint a token is bound to.
+func (c Claims) confirmationJKT() string {
+    cnf, _ := c["cnf"].(map[string]any)
+    s, _ := cnf["jkt"].(string)
+    return s
+}
+
+// verify checks the request's DPoP proof for accessToken and returns the
+// proof key's thumbprint.
+func (d *DPoP) verify(c *gin.Context, accessToken string) (string, error) {
+    proofs := c.Request.Header.Values("DPoP")
+    if len(proofs) != 1 {
+        return "", tokenError(ReasonInvalidDPoP, ErrDPoPProof, errors.New("exactly one DPoP header required"))
+    }
+    var jkt string
+    parser := &jwt.Parser{ValidMethods: dpopAlgs, SkipClaimsValidation: true}
+    var claims jwt.MapClaims
+    _, err := parser.ParseWithClaims(proofs[0], &claims, func(t *jwt.Token) (any, error) {
+        if typ, _ := t.Header["typ"].(string); !strings.EqualFold(typ, "dpop+jwt") {
+            return nil, errors.New("typ must be dpop+jwt")
+        }
+        jwk, ok := t.Header["jwk"].(map[string]any)
+        if !ok {
+            return nil, errors.New("missing jwk header")
+        }
+        key, thumb, err := parsePublicJWK(jwk)
+        if err != nil {
+            return nil, err
+        }
+        jkt = thumb
+        return key, nil
+    })
+    if err != nil {
+        return "", tokenError(ReasonInvalidDPoP, ErrDPoPProof, err)
+    }
+
+    if htm, _ := claims["htm"].(string); htm != c.Request.Method {
+        return "", tokenError(ReasonInvalidDPoP, ErrDPoPProof, fmt.Errorf("htm %q does not match %s", htm, c.Request.Method))
+    }
+    htu, _ := claims["htu"].(string)
+    if want := d.requestURI(c); !sameHTU(htu, want) {
+        return "", tokenError(ReasonInvalidDPoP, ErrDPoPProof, fmt.Errorf("htu %q does not match %q", htu, want))
+    }
+    iat, ok := Claims(claims).IssuedAt()
+    now, leeway := time.Now(), d.auth.leeway
+    if !ok || now.Sub(iat) > d.cfg.MaxAge+leeway || iat.After(now.Add(leeway)) {
+        return "", tokenError(ReasonInvalidDPoP, ErrDPoPProof, fmt.Errorf("iat %v outside the accepted window", claims["iat"]))
+    }
+    sum := sha256.Sum256([]byte(accessToken))
+    ath, _ := claims["ath"].(string)
+    if subtle.ConstantTimeCompare([]byte(ath), []byte(base64.RawURLEncoding.EncodeToString(sum[:]))) != 1 {
+        return "", tokenError(ReasonInvalidDPoP, ErrDPoPProof, errors.New("ath does not match the access token"))
+    }
+    jti, _ := claims["jti"].(string)
+    if jti == "" {
+        return "", tokenError(ReasonInvalidDPoP, ErrDPoPProof, errors.New("missing jti"))
+    }
+
+    key := sha256.Sum256([]byte(jkt + ":" + jti))
+    seen, err := d.cfg.Replay.Seen(c.Request.Context(), hex.EncodeToString(key[:]), iat.Add(d.cfg.MaxAge+2*leeway))
+    if err != nil {
+        return "", tokenError(ReasonIntrospectionFailed, fmt.Errorf("dpop replay check: %w", err), err)
+    }
+    if seen {
+        return "", tokenError(ReasonDPoPReplay, ErrDPoPReplay, fmt.Errorf("jti %q", jti))
+    }
+    return jkt, nil
+}
+
+// requestURI rebuilds the URI the client called, without query or fragment.
+func (d *DPoP) requestURI(c *gin.Context) string {
+    return d.cfg.PublicBaseURL + c.Request.URL.Path
+}
+
+// sameHTU compares htu values ignoring query, fragment, scheme/host case
+// and default ports (RFC 9449 §4.3).
+func sameHTU(got, want string) bool {
+    g, err1 := url.Parse(got)
+    w, err2 := url.Parse(want)
+    if err1 != nil || err2 != nil || got == "" {
+        return false
+    }
+    norm := func(u *url.URL) string {
+        host := strings.ToLower(u.Host)
+        scheme := strings.ToLower(u.Scheme)
+        host = strings.TrimSuffix(host, map[string]string{"https": ":443", "http": ":80"}[scheme])
+        return scheme + "://" + host + u.EscapedPath()
+    }
+    return norm(g) == norm(w)
+}
+
+// parsePublicJWK converts a JWK into a public key and its RFC 7638 thumbprint.
+func parsePublicJWK(jwk map[string]any) (crypto.PublicKey, string, error) {
+    str := func(name string) string { s, _ := jwk[name].(string); return s }
+    if str("d") != "" {
+        return nil, "", errors.New("jwk must not contain a private key")
+    }
+    b64 := func(name string) ([]byte, error) {
+        b, err := base64.RawURLEncoding.DecodeString(str(name))
+        if err != nil || len(b) == 0 {
+            return nil, fmt.Errorf("jwk: invalid %s", name)
+        }
+        return b, nil
+    }
+    var key crypto.PublicKey
+    var canonical string
+    switch str("kty") {
+    case "RSA":
+        n, err := b64("n")
+        if err != nil {
+            return nil, "", err
+        }
+        e, err := b64("e")
+        if err != nil {
+            return nil, "", err
+        }
+        pk := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+        if pk.N.BitLen() < minRSAKeyBits {
+            return nil, "", fmt.Errorf("jwk: RSA key has %d bits, need at least %d", pk.N.BitLen(), minRSAKeyBits)
+        }
+        if len(e) > 4 || pk.E < 3 || pk.E%2 == 0 {
+            return nil, "", errors.New("jwk: invalid RSA exponent")
+        }
+        key = pk
+        canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, str("e"), str("n"))
+    case "EC":
+        var curve elliptic.Curve
+        switch str("crv") {
+        case "P-256":
+            curve = elliptic.P256()
+        case "P-384":
+            curve = elliptic.P384()
+        case "P-521":
+            curve = elliptic.P521()
+        default:
+            return nil, "", fmt.Errorf("jwk: unsupported curve %q", str("crv"))
+        }
+        x, err := b64("x")
+        if err != nil {
+            return nil, "", err
+        }
+        y, err := b64("y")
+        if err != nil {
+            return nil, "", err
+        }
+        pk := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+        if !curve.IsOnCurve(pk.X, pk.Y) {
+            return nil, "", errors.New("jwk: point not on curve")
+        }
+        key = pk
+        canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, str("crv"), str("x"), str("y"))
+    case "OKP":
+        if str("crv") != "Ed25519" {
+            return nil, "", fmt.Errorf("jwk: unsupported curve %q", str("crv"))
+        }
+        x, err := b64("x")
+        if err != nil || len(x) != ed25519.PublicKeySize {
+            return nil, "", errors.New("jwk: invalid x")
+        }
+        key = ed25519.PublicKey(x)
+        canonical = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":%q}`, str("x"))
+    default:
+        return nil, "", fmt.Errorf("jwk: unsupported kty %q", str("kty"))
+    }
+    sum := sha256.Sum256([]byte(canonical))
+    return key, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// memoryReplayCache is a bounded in-memory ReplayCache. Entries sit in a
+// min-heap by expiry, since proofs arrive with different iat values and so
+// do not expire in arrival order; when full, the entry closest to expiry is
+// dropped. Use the database cache with several replicas.
+type memoryReplayCache struct {
+    mu    sync.Mutex
+    max   int
+    heap  replayHeap
+    items map[string]*replayEntry
+}
+
+type replayEntry struct {
+    key     string
+    expires time.Time
+    index   int // position in the heap
+}
+
+// replayHeap orders entries by expiry, earliest first (container/heap).
+type replayHeap []*replayEntry
+
+func (h replayHeap) Len() int           { return len(h) }
+func (h replayHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h replayHeap) Swap(i, j int) {
+    h[i], h[j] = h[j], h[i]
+    h[i].index, h[j].index = i, j
+}
+func (h *replayHeap) Push(x any) {
+    e := x.(*replayEntry)
+    e.index = len(*h)
+    *h = append(*h, e)
+}
+func (h *replayHeap) Pop() any {
+    old := *h
+    e := old[len(old)-1]
+    old[len(old)-1] = nil
+    *h = old[:len(old)-1]
+    return e
+}
+
+// NewMemoryReplayCache builds an in-memory replay cache holding up to max
+// proof identifiers.
+func NewMemoryReplayCache(max int) ReplayCache {
+    if max <= 0 {
+        max = 100000
+    }
+    return &memoryReplayCache{max: max, items: make(map[string]*replayEntry)}
+}
+
+func (m *memoryReplayCache) Seen(_ context.Context, key string, expires time.Time) (bool, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    now := time.Now()
+    // Drop everything that expired, whatever order it arrived in.
+    for len(m.heap) > 0 && !now.Before(m.heap[0].expires) {
+        delete(m.items, heap.Pop(&m.heap).(*replayEntry).key)
+    }
+    if _, ok := m.items[key]; ok {
+        return true, nil
+    }
+    e := &replayEntry{key: key, expires: expires}
+    heap.Push(&m.heap, e)
+    m.items[key] = e
+    for len(m.heap) > m.max {
+        delete(m.items, heap.Pop(&m.heap).(*replayEntry).key)
+    }
+    return false, nil
+}
+
+// dbReplayCache stores proof identifiers in the dpop_proofs table so all
+// replicas share them.
+type dbReplayCache struct {
+    db        *gorm.DB
+    mu        sync.Mutex
+    lastPurge time.Time
+}
+
+// NewDBReplayCache builds a ReplayCache backed by the dpop_proofs table.
+func NewDBReplayCache(db *gorm.DB) ReplayCache {
+    return &dbReplayCache{db: db}
+}
+
+func (d *dbReplayCache) Seen(ctx context.Context, key string, expires time.Time) (bool, error) {
+    d.purge(ctx)
+    res := d.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+        Create(&models.DPoPProof{JTI: key, ExpiresAt: expires})
+    if res.Error != nil {
+        return false, res.Error
+    }
+    return res.RowsAffected == 0, nil
+}
+
+// purge deletes expired rows at most once a minute.
+func (d *dbReplayCache) purge(ctx context.Context) {
+    d.mu.Lock()
+    if time.Since(d.lastPurge) < time.Minute {
+        d.mu.Unlock()
+        return
+    }
+    d.lastPurge = time.Now()
+    d.mu.Unlock()
+    d.db.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&models.DPoPProof{})
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+    "errors"
+    "expvar"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+
+    "github.com/MicahParks/keyfunc"
+    "github.com/gin-gonic/gin"
+    jwt "github.com/golang-jwt/jwt/v4"
+
+    "smart-transit-system/internal/httperr"
+)
+
+// Reason codes for authentication failures. They are logged and counted
+// (expvar "auth_failures") but never sent to clients, which only see the
+// RFC 6750 error code and description.
+const (
+    ReasonMissingToken        = "missing_token"
+    ReasonMalformed           = "malformed"
+    ReasonBadSignature        = "bad_signature"
+    ReasonUnknownKID          = "unknown_kid"
+    ReasonExpired             = "expired"
+    ReasonNotYetValid         = "not_yet_valid"
+    ReasonWrongIssuer         = "wrong_issuer"
+    ReasonWrongAudience       = "wrong_audience"
+    ReasonInvalidClaims       = "invalid_claims"
+    ReasonTokenTooOld         = "token_too_old"
+    ReasonAuthTooOld          = "auth_too_old"
+    ReasonInsufficientAuth    = "insufficient_auth_level"
+    ReasonInvalidDPoP         = "invalid_dpop_proof"
+    ReasonDPoPReplay          = "dpop_replay"
+    ReasonDPoPBinding         = "dpop_binding_mismatch"
+    ReasonCertBinding         = "cert_binding_mismatch"
+    ReasonRevoked             = "revoked"
+    ReasonUserDisabled        = "user_disabled"
+    ReasonInactive            = "inactive"
+    ReasonIntrospectionFailed = "introspection_failed"
+    ReasonInvalidSession      = "invalid_session"
+    ReasonCSRF                = "csrf"
+    ReasonInsufficientScope   = "insufficient_scope"
+    ReasonClientNotAllowed    = "client_not_allowed"
+)
+
+// realm is advertised in WWW-Authenticate challenges.
+const realm = "smart-transit"
+
+var failures = expvar.NewMap("auth_failures")
+
+// TokenError is a token validation failure. It unwraps to one of the
+// ErrInvalid*/ErrToken* sentinels, whose message is returned to clients;
+// Cause keeps the underlying library error for the logs.
+type TokenError struct {
+    Reason string
+    Err    error
+    Cause  error
+}
+
+func (e *TokenError) Error() string { return e.Err.Error() }
+func (e *TokenError) Unwrap() error { return e.Err }
+
+func tokenError(reason string, err, cause error) *TokenError {
+    return &TokenError{Reason: reason, Err: err, Cause: cause}
+}
+
+// FailureCounts returns the number of authentication failures per reason
+// since startup.
+func FailureCounts() map[string]int64 {
+    out := make(map[string]int64)
+    failures.Do(func(kv expvar.KeyValue) {
+        if v, ok := kv.Value.(*expvar.Int); ok {
+            out[kv.Key] = v.Value()
+        }
+    })
+    return out
+}
+
+// classifyJWTError maps a jwt parse error to a TokenError. The signature
+// bit is checked first: jwt/v4 validates time claims before the signature,
+// so a forged expired token carries both.
+func classifyJWTError(err error) *TokenError {
+    switch {
+    case errors.Is(err, keyfunc.ErrKIDNotFound):
+        return tokenError(ReasonUnknownKID, ErrInvalidToken, err)
+    case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+        return tokenError(ReasonBadSignature, ErrInvalidToken, err)
+    case errors.Is(err, jwt.ErrTokenExpired):
+        return tokenError(ReasonExpired, ErrTokenExpired, err)
+    case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+        return tokenError(ReasonNotYetValid, ErrTokenExpired, err)
+    }
+    return tokenError(ReasonMalformed, ErrInvalidToken, err)
+}
+
+// recordFailure logs and counts an authentication failure.
+func recordFailure(c *gin.Context, reason string, err error) {
+    failures.Add(reason, 1)
+    detail := ""
+    var te *TokenError
+    if errors.As(err, &te) && te.Cause != nil {
+        detail = te.Cause.Error()
+    } else if err != nil {
+        detail = err.Error()
+    }
+    log.Printf("auth: %s %s rejected reason=%s ip=%s detail=%q", c.Request.Method, c.Request.URL.Path, reason, c.ClientIP(), detail)
+}
+
+// challenge formats a WWW-Authenticate challenge (RFC 6750 §3) for the
+// scheme the client used (Bearer or DPoP). Empty parameters are omitted.
+func challenge(c *gin.Context, params ...string) string {
+    parts := []string{fmt.Sprintf("realm=%q", realm)}
+    for i := 0; i+1 < len(params); i += 2 {
+        if params[i+1] != "" {
+            v := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(params[i+1])
+            parts = append(parts, params[i]+`="`+v+`"`)
+        }
+    }
+    if authScheme(c) == "DPoP" {
+        parts = append(parts, `algs="`+strings.Join(dpopAlgs, " ")+`"`)
+        return "DPoP " + strings.Join(parts, ", ")
+    }
+    return "Bearer " + strings.Join(parts, ", ")
+}
+
+// abortMissingToken rejects a request that carried no credentials. Per
+// RFC 6750 §3.1 the challenge has no error code in that case.
+func abortMissingToken(c *gin.Context, message string) {
+    recordFailure(c, ReasonMissingToken, nil)
+    c.Header("WWW-Authenticate", challenge(c))
+    httperr.AbortCode(c, http.StatusUnauthorized, "unauthorized", message, nil)
+}
+
+// abortInvalidToken rejects a request whose token failed validation.
+// Introspection transport errors are reported as 503 since the token may
+// well be valid.
+func abortInvalidToken(c *gin.Context, err error) {
+    var te *TokenError
+    if !errors.As(err, &te) {
+        te = tokenError(ReasonIntrospectionFailed, err, nil)
+    }
+    recordFailure(c, te.Reason, err)
+    switch te.Reason {
+    case ReasonIntrospectionFailed:
+        httperr.Abort(c, http.StatusServiceUnavailable, "token validation unavailable")
+        return
+    case ReasonUserDisabled:
+        // The token is fine; the account is not. No challenge: logging in
+        // again would not help.
+        httperr.AbortCode(c, http.StatusForbidden, "account_disabled", te.Error(), nil)
+        return
+    }
+    code := "invalid_token"
+    if te.Reason == ReasonInvalidDPoP || te.Reason == ReasonDPoPReplay {
+        code = "invalid_dpop_proof"
+    }
+    c.Header("WWW-Authenticate", challenge(c, "error", code, "error_description", te.Error()))
+    httperr.AbortCode(c, http.StatusUnauthorized, code, te.Error(), nil)
+}
+
+// abortInsufficientScope rejects a request whose token lacks a scope.
+func abortInsufficientScope(c *gin.Context, missing string, required []string) {
+    recordFailure(c, ReasonInsufficientScope, errors.New("missing scope "+missing))
+    desc := "missing scope: " + missing
+    c.Header("WWW-Authenticate", challenge(c, "error", "insufficient_scope", "error_description", desc, "scope", strings.Join(required, " ")))
+    httperr.AbortCode(c, http.StatusForbidden, "insufficient_scope", desc, nil)
+}
+
+// authScheme returns the authorization scheme of the request.
+func authScheme(c *gin.Context) string {
+    if strings.HasPrefix(strings.ToLower(c.GetHeader("Authorization")), "dpop ") {
+        return "DPoP"
+    }
+    return "Bearer"
+}
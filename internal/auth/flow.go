@@ -0,0 +1,342 @@
+package auth
+
+import (
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// FlowConfig configures the server-side authorization code + PKCE flow.
+type FlowConfig struct {
+    ClientID     string
+    ClientSecret string // optional; public clients rely on PKCE alone
+    RedirectURI  string // must point at this service's /auth/callback
+    Scopes       string // defaults to "openid profile email"
+    StateSecret  string // key for the encrypted state; random per process when empty
+    CookieName   string // login binding cookie; defaults to "sts_login"
+    CookieSecure bool   // set Secure on the binding cookie (HTTPS only)
+}
+
+// Flow runs the authorization code + PKCE login on behalf of clients that
+// cannot (or should not) implement PKCE themselves. The PKCE verifier and
+// nonce travel inside the state, encrypted with AES-GCM, so the callback
+// can land on any replica sharing the state secret. The state is bound to
+// the browser that started the login by a random value kept both in the
+// state and in a short-lived cookie, so a callback URL cannot be replayed
+// in someone else's browser (login CSRF).
+type Flow struct {
+    auth         *Auth
+    clientID     string
+    clientSecret string
+    redirectURI  string
+    scopes       string
+    aead         cipher.AEAD
+    ttl          time.Duration
+    httpClient   *http.Client
+    cookieName   string
+    cookieSecure bool
+}
+
+// pendingLogin is the sealed content of the state parameter.
+type pendingLogin struct {
+    Verifier string `json:"v"`
+    Nonce    string `json:"n"`
+    Browser  string `json:"b"` // must match the login binding cookie
+    Expires  int64  `json:"exp"`
+}
+
+// stateAD binds sealed states to this use of the secret.
+var stateAD = []byte("auth-flow-state")
+
+// TokenSet is the result of a successful code exchange.
+type TokenSet struct {
+    AccessToken  string `json:"access_token"`
+    IDToken      string `json:"id_token,omitempty"`
+    RefreshToken string `json:"refresh_token,omitempty"`
+    TokenType    string `json:"token_type"`
+    ExpiresIn    int    `json:"expires_in"`
+    Scope        string `json:"scope,omitempty"`
+    IDClaims     Claims `json:"-"`
+}
+
+var (
+    ErrInvalidState = errors.New("invalid or expired state")
+    ErrIDToken      = errors.New("invalid id_token")
+)
+
+// NewFlow builds a login flow bound to the given authenticator.
+func NewFlow(a *Auth, cfg FlowConfig) (*Flow, error) {
+    if a == nil {
+        return nil, errors.New("authenticator is required")
+    }
+    if cfg.ClientID == "" || cfg.RedirectURI == "" {
+        return nil, errors.New("client id and redirect uri are required")
+    }
+    if cfg.CookieName == "" {
+        cfg.CookieName = "sts_login"
+    }
+    scopes := cfg.Scopes
+    if scopes == "" {
+        scopes = "openid profile email"
+    }
+    secret := []byte(cfg.StateSecret)
+    if len(secret) == 0 {
+        secret = make([]byte, 32)
+        if _, err := rand.Read(secret); err != nil {
+            return nil, fmt.Errorf("state secret: %w", err)
+        }
+    }
+    // The secret may be any length; AES-256 takes its SHA-256.
+    key := sha256.Sum256(secret)
+    block, err := aes.NewCipher(key[:])
+    if err != nil {
+        return nil, fmt.Errorf("state cipher: %w", err)
+    }
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, fmt.Errorf("state cipher: %w", err)
+    }
+    return &Flow{
+        auth:         a,
+        clientID:     cfg.ClientID,
+        clientSecret: cfg.ClientSecret,
+        redirectURI:  cfg.RedirectURI,
+        scopes:       scopes,
+        aead:         aead,
+        ttl:          10 * time.Minute,
+        httpClient:   &http.Client{Timeout: 10 * time.Second},
+        cookieName:   cfg.CookieName,
+        cookieSecure: cfg.CookieSecure,
+    }, nil
+}
+
+// Begin creates a PKCE verifier and nonce, seals them into the state, sets
+// the login binding cookie, and returns the authorize URL the user agent
+// should be sent to.
+func (f *Flow) Begin(c *gin.Context) (string, error) {
+    verifier, err := randomString(48)
+    if err != nil {
+        return "", err
+    }
+    nonce, err := randomString(16)
+    if err != nil {
+        return "", err
+    }
+    browser, err := randomString(24)
+    if err != nil {
+        return "", err
+    }
+    state, err := f.sealState(pendingLogin{Verifier: verifier, Nonce: nonce, Browser: browser, Expires: time.Now().Add(f.ttl).Unix()})
+    if err != nil {
+        return "", err
+    }
+    // Lax: the IdP's redirect back to the callback is a top-level GET.
+    c.SetSameSite(http.SameSiteLaxMode)
+    c.SetCookie(f.cookieName, browser, int(f.ttl.Seconds()), "/", "", f.cookieSecure, true)
+
+    sum := sha256.Sum256([]byte(verifier))
+    q := url.Values{}
+    q.Set("response_type", "code")
+    q.Set("client_id", f.clientID)
+    q.Set("redirect_uri", f.redirectURI)
+    q.Set("scope", f.scopes)
+    q.Set("state", state)
+    q.Set("nonce", nonce)
+    q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+    q.Set("code_challenge_method", "S256")
+
+    endpoint := f.auth.AuthorizationEndpoint()
+    sep := "?"
+    if strings.Contains(endpoint, "?") {
+        sep = "&"
+    }
+    return endpoint + sep + q.Encode(), nil
+}
+
+// Complete validates the state against the login binding cookie (which it
+// then clears), exchanges the code at the token endpoint and verifies the
+// returned ID token.
+func (f *Flow) Complete(c *gin.Context, state, code string) (*TokenSet, error) {
+    p, ok := f.openState(state)
+    if !ok || time.Now().Unix() > p.Expires {
+        return nil, ErrInvalidState
+    }
+    browser, err := c.Cookie(f.cookieName)
+    if err != nil || browser == "" || subtle.ConstantTimeCompare([]byte(browser), []byte(p.Browser)) != 1 {
+        return nil, ErrInvalidState
+    }
+    c.SetSameSite(http.SameSiteLaxMode)
+    c.SetCookie(f.cookieName, "", -1, "/", "", f.cookieSecure, true)
+    ctx := c.Request.Context()
+    if code == "" {
+        return nil, errors.New("missing authorization code")
+    }
+
+    form := url.Values{}
+    form.Set("grant_type", "authorization_code")
+    form.Set("code", code)
+    form.Set("redirect_uri", f.redirectURI)
+    form.Set("code_verifier", p.Verifier)
+    ts, err := f.tokenRequest(ctx, form)
+    if err != nil {
+        return nil, err
+    }
+    if ts.IDToken == "" {
+        return nil, fmt.Errorf("%w: missing from token response", ErrIDToken)
+    }
+    claims, err := f.auth.VerifyIDToken(ts.IDToken, f.clientID, p.Nonce)
+    if err != nil {
+        return nil, err
+    }
+    ts.IDClaims = claims
+    return ts, nil
+}
+
+// Refresh exchanges a refresh token for a new token set.
+func (f *Flow) Refresh(ctx context.Context, refreshToken string) (*TokenSet, error) {
+    form := url.Values{}
+    form.Set("grant_type", "refresh_token")
+    form.Set("refresh_token", refreshToken)
+    return f.tokenRequest(ctx, form)
+}
+
+// tokenRequest posts a form to the token endpoint and decodes the response.
+func (f *Flow) tokenRequest(ctx context.Context, form url.Values) (*TokenSet, error) {
+    form.Set("client_id", f.clientID)
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.auth.TokenEndpoint(), strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    if f.clientSecret != "" {
+        req.SetBasicAuth(url.QueryEscape(f.clientID), url.QueryEscape(f.clientSecret))
+    }
+    resp, err := f.httpClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("token endpoint: %w", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        var oe struct {
+            Error            string `json:"error"`
+            ErrorDescription string `json:"error_description"`
+        }
+        _ = json.NewDecoder(resp.Body).Decode(&oe)
+        if oe.Error != "" {
+            return nil, fmt.Errorf("token endpoint: %s: %s", oe.Error, oe.ErrorDescription)
+        }
+        return nil, fmt.Errorf("token endpoint: status %d", resp.StatusCode)
+    }
+    var ts TokenSet
+    if err := json.NewDecoder(resp.Body).Decode(&ts); err != nil {
+        return nil, fmt.Errorf("decode token response: %w", err)
+    }
+    if ts.AccessToken == "" {
+        return nil, errors.New("token endpoint: missing access_token")
+    }
+    return &ts, nil
+}
+
+// VerifyIDToken validates an ID token signature, issuer, audience, expiry
+// and (when non-empty) nonce using the authenticator's JWKS.
+func (a *Auth) VerifyIDToken(raw, clientID, nonce string) (Claims, error) {
+    parser := &jwt.Parser{ValidMethods: []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}, SkipClaimsValidation: true}
+    parsed, err := parser.Parse(raw, a.primary.jwks.Keyfunc)
+    if err != nil || !parsed.Valid {
+        return nil, fmt.Errorf("%w: signature", ErrIDToken)
+    }
+    m, ok := parsed.Claims.(jwt.MapClaims)
+    if !ok {
+        return nil, fmt.Errorf("%w: claims", ErrIDToken)
+    }
+    iss, _ := m["iss"].(string)
+    if !a.validIssuer(iss) {
+        return nil, fmt.Errorf("%w: issuer", ErrIDToken)
+    }
+    if !m.VerifyAudience(clientID, true) {
+        return nil, fmt.Errorf("%w: audience", ErrIDToken)
+    }
+    if err := a.validateTimes(m); err != nil {
+        return nil, fmt.Errorf("%w: expired or not yet valid", ErrIDToken)
+    }
+    if nonce != "" {
+        if got, _ := m["nonce"].(string); !hmac.Equal([]byte(got), []byte(nonce)) {
+            return nil, fmt.Errorf("%w: nonce", ErrIDToken)
+        }
+    }
+    return Claims(m), nil
+}
+
+// VerifyIDTokenHint checks an id_token_hint for logout: signature, issuer
+// and audience must be valid, but the token may have expired.
+func (a *Auth) VerifyIDTokenHint(raw, clientID string) (Claims, error) {
+    parser := &jwt.Parser{ValidMethods: []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}, SkipClaimsValidation: true}
+    parsed, err := parser.Parse(raw, a.primary.jwks.Keyfunc)
+    if err != nil || !parsed.Valid {
+        return nil, fmt.Errorf("%w: signature", ErrIDToken)
+    }
+    m, ok := parsed.Claims.(jwt.MapClaims)
+    if !ok {
+        return nil, fmt.Errorf("%w: claims", ErrIDToken)
+    }
+    if iss, _ := m["iss"].(string); !a.validIssuer(iss) {
+        return nil, fmt.Errorf("%w: issuer", ErrIDToken)
+    }
+    if !m.VerifyAudience(clientID, true) {
+        return nil, fmt.Errorf("%w: audience", ErrIDToken)
+    }
+    return Claims(m), nil
+}
+
+// sealState encrypts p into an opaque state value (nonce || ciphertext).
+// Encryption, not just a MAC, keeps the verifier secret from anything that
+// sees the authorize URL.
+func (f *Flow) sealState(p pendingLogin) (string, error) {
+    plain, err := json.Marshal(p)
+    if err != nil {
+        return "", err
+    }
+    nonce := make([]byte, f.aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(f.aead.Seal(nonce, nonce, plain, stateAD)), nil
+}
+
+func (f *Flow) openState(state string) (pendingLogin, bool) {
+    var p pendingLogin
+    raw, err := base64.RawURLEncoding.DecodeString(state)
+    if err != nil || len(raw) < f.aead.NonceSize() {
+        return p, false
+    }
+    n := f.aead.NonceSize()
+    plain, err := f.aead.Open(nil, raw[:n], raw[n:], stateAD)
+    if err != nil || json.Unmarshal(plain, &p) != nil || p.Verifier == "" {
+        return p, false
+    }
+    return p, true
+}
+
+func randomString(n int) (string, error) {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,310 @@
+package auth
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// oidcStub is a minimal OpenID provider: discovery, JWKS and a token
+// endpoint that checks the PKCE verifier of codes issued via authorize.
+type oidcStub struct {
+    *httptest.Server
+    key *rsa.PrivateKey
+
+    mu    sync.Mutex
+    codes map[string]stubCode // code -> the authorize request it answers
+    // idNonce, when set, replaces the nonce put into ID tokens.
+    idNonce string
+}
+
+type stubCode struct {
+    challenge string
+    nonce     string
+}
+
+func newOIDCStub(t *testing.T) *oidcStub {
+    t.Helper()
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := &oidcStub{key: key, codes: map[string]stubCode{}}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        _ = json.NewEncoder(w).Encode(map[string]string{
+            "issuer":                 s.URL,
+            "jwks_uri":               s.URL + "/jwks",
+            "authorization_endpoint": s.URL + "/authorize",
+            "token_endpoint":         s.URL + "/token",
+        })
+    })
+    mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+        _ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+            "kty": "RSA",
+            "kid": "k1",
+            "use": "sig",
+            "alg": "RS256",
+            "n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+            "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+        }}})
+    })
+    mux.HandleFunc("/token", s.token)
+    s.Server = httptest.NewServer(mux)
+    t.Cleanup(s.Close)
+    return s
+}
+
+// authorize plays the user logging in: it records the request's PKCE
+// challenge and nonce and returns the code the IdP would redirect with.
+func (s *oidcStub) authorize(t *testing.T, authorizeURL string) (code, state string) {
+    t.Helper()
+    u, err := url.Parse(authorizeURL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    q := u.Query()
+    code = "code-" + q.Get("nonce")
+    s.mu.Lock()
+    s.codes[code] = stubCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+    s.mu.Unlock()
+    return code, q.Get("state")
+}
+
+func (s *oidcStub) token(w http.ResponseWriter, r *http.Request) {
+    if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" {
+        http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+        return
+    }
+    s.mu.Lock()
+    c, ok := s.codes[r.Form.Get("code")]
+    delete(s.codes, r.Form.Get("code"))
+    idNonce := s.idNonce
+    s.mu.Unlock()
+    sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+    if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != c.challenge {
+        w.WriteHeader(http.StatusBadRequest)
+        _, _ = w.Write([]byte(`{"error":"invalid_grant","error_description":"code or verifier mismatch"}`))
+        return
+    }
+    if idNonce == "" {
+        idNonce = c.nonce
+    }
+    now := time.Now()
+    tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+        "iss":   s.URL,
+        "sub":   "user-1",
+        "aud":   r.Form.Get("client_id"),
+        "iat":   now.Unix(),
+        "exp":   now.Add(time.Hour).Unix(),
+        "nonce": idNonce,
+    })
+    tok.Header["kid"] = "k1"
+    idToken, err := tok.SignedString(s.key)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]any{
+        "access_token": "at-1",
+        "id_token":     idToken,
+        "token_type":   "Bearer",
+        "expires_in":   3600,
+    })
+}
+
+func newTestFlow(t *testing.T, stub *oidcStub, secret string) *Flow {
+    t.Helper()
+    a, err := New(stub.URL, "", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f, err := NewFlow(a, FlowConfig{ClientID: "client-1", RedirectURI: "https://app.example/callback", StateSecret: secret})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return f
+}
+
+// begin starts a login in a fresh browser and returns the authorize URL and
+// the binding cookie set on it.
+func begin(t *testing.T, f *Flow) (string, *http.Cookie) {
+    t.Helper()
+    gin.SetMode(gin.TestMode)
+    w := httptest.NewRecorder()
+    c, _ := gin.CreateTestContext(w)
+    c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/auth/start", nil)
+    raw, err := f.Begin(c)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, ck := range w.Result().Cookies() {
+        if ck.Name == f.cookieName {
+            return raw, ck
+        }
+    }
+    t.Fatal("Begin set no login cookie")
+    return "", nil
+}
+
+// complete runs the callback in a browser holding cookie (none when nil).
+func complete(f *Flow, state, code string, cookie *http.Cookie) (*TokenSet, *httptest.ResponseRecorder, error) {
+    w := httptest.NewRecorder()
+    c, _ := gin.CreateTestContext(w)
+    c.Request = httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/api/v1/auth/callback", nil)
+    if cookie != nil {
+        c.Request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+    }
+    ts, err := f.Complete(c, state, code)
+    return ts, w, err
+}
+
+func TestFlowBeginRedirect(t *testing.T) {
+    stub := newOIDCStub(t)
+    f := newTestFlow(t, stub, "secret")
+
+    raw, cookie := begin(t, f)
+    if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.MaxAge <= 0 {
+        t.Errorf("login cookie = %+v, want short-lived HttpOnly SameSite=Lax", cookie)
+    }
+    u, err := url.Parse(raw)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := u.Scheme + "://" + u.Host + u.Path; got != stub.URL+"/authorize" {
+        t.Errorf("authorize endpoint = %s", got)
+    }
+    q := u.Query()
+    for k, want := range map[string]string{
+        "response_type":         "code",
+        "client_id":             "client-1",
+        "redirect_uri":          "https://app.example/callback",
+        "scope":                 "openid profile email",
+        "code_challenge_method": "S256",
+    } {
+        if q.Get(k) != want {
+            t.Errorf("%s = %q, want %q", k, q.Get(k), want)
+        }
+    }
+    if len(q.Get("code_challenge")) != 43 || q.Get("nonce") == "" || q.Get("state") == "" {
+        t.Errorf("missing PKCE challenge, nonce or state: %v", q)
+    }
+    // The state is opaque: the verifier must not be readable from the URL.
+    p, ok := f.openState(q.Get("state"))
+    if !ok {
+        t.Fatal("state does not open")
+    }
+    if strings.Contains(raw, p.Verifier) {
+        t.Error("authorize URL leaks the PKCE verifier")
+    }
+}
+
+func TestFlowCompleteExchange(t *testing.T) {
+    stub := newOIDCStub(t)
+    f := newTestFlow(t, stub, "secret")
+    // A second replica with the same secret completes the login.
+    other := newTestFlow(t, stub, "secret")
+
+    raw, cookie := begin(t, f)
+    code, state := stub.authorize(t, raw)
+    ts, w, err := complete(other, state, code, cookie)
+    if err != nil {
+        t.Fatalf("Complete: %v", err)
+    }
+    if ts.AccessToken != "at-1" || ts.IDClaims.Subject() != "user-1" {
+        t.Errorf("unexpected token set: %+v", ts)
+    }
+    if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Name != cookie.Name || cookies[0].MaxAge >= 0 {
+        t.Errorf("login cookie not cleared: %v", cookies)
+    }
+}
+
+func TestFlowCompleteRequiresLoginCookie(t *testing.T) {
+    stub := newOIDCStub(t)
+    f := newTestFlow(t, stub, "secret")
+
+    // The attacker starts a login and stops at the callback; the victim's
+    // browser holds no cookie, or the one of its own login.
+    raw, _ := begin(t, f)
+    code, state := stub.authorize(t, raw)
+    _, victimCookie := begin(t, f)
+    for name, cookie := range map[string]*http.Cookie{"no cookie": nil, "another login": victimCookie} {
+        if _, _, err := complete(f, state, code, cookie); !errors.Is(err, ErrInvalidState) {
+            t.Errorf("%s: err = %v, want ErrInvalidState", name, err)
+        }
+    }
+}
+
+func TestFlowCompleteStateMismatch(t *testing.T) {
+    stub := newOIDCStub(t)
+    f := newTestFlow(t, stub, "secret")
+
+    raw, cookie := begin(t, f)
+    code, state := stub.authorize(t, raw)
+
+    tampered := []byte(state)
+    tampered[len(tampered)/2] ^= 1
+    expired, err := f.sealState(pendingLogin{Verifier: "v", Nonce: "n", Expires: time.Now().Add(-time.Minute).Unix()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    cases := map[string]struct {
+        flow  *Flow
+        state string
+    }{
+        "empty":        {f, ""},
+        "garbage":      {f, "not-a-state"},
+        "tampered":     {f, string(tampered)},
+        "other secret": {newTestFlow(t, stub, "another-secret"), state},
+        "expired":      {f, expired},
+    }
+    for name, tc := range cases {
+        if _, _, err := complete(tc.flow, tc.state, code, cookie); !errors.Is(err, ErrInvalidState) {
+            t.Errorf("%s: err = %v, want ErrInvalidState", name, err)
+        }
+    }
+}
+
+func TestFlowCompleteNonceMismatch(t *testing.T) {
+    stub := newOIDCStub(t)
+    f := newTestFlow(t, stub, "secret")
+    stub.idNonce = "someone-elses-nonce"
+
+    raw, cookie := begin(t, f)
+    code, state := stub.authorize(t, raw)
+    _, _, err := complete(f, state, code, cookie)
+    if !errors.Is(err, ErrIDToken) || !strings.Contains(err.Error(), "nonce") {
+        t.Fatalf("err = %v, want nonce ErrIDToken", err)
+    }
+}
+
+func TestFlowCompleteWrongVerifier(t *testing.T) {
+    stub := newOIDCStub(t)
+    f := newTestFlow(t, stub, "secret")
+
+    first, _ := begin(t, f)
+    second, cookie := begin(t, f)
+    code, _ := stub.authorize(t, first)
+    _, state := stub.authorize(t, second)
+    // The second login's verifier does not match the first code's challenge.
+    _, _, err := complete(f, state, code, cookie)
+    if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+        t.Fatalf("err = %v, want invalid_grant from the token endpoint", err)
+    }
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    jwt "github.com/golang-jwt/jwt/v4"
+
+    "smart-transit-system/internal/httperr"
+)
+
+// ErrTokenTooOld is returned when a token's iat is older than allowed.
+var ErrTokenTooOld = errors.New("token is too old")
+
+// DefaultLeeway is the clock skew tolerated on exp, nbf and iat.
+const DefaultLeeway = 60 * time.Second
+
+// SetLeeway sets the clock skew tolerated on exp, nbf and iat (devices on
+// buses often drift). Negative values are treated as zero.
+func (a *Auth) SetLeeway(d time.Duration) {
+    if d < 0 {
+        d = 0
+    }
+    a.leeway = d
+}
+
+// numericDate reads a NumericDate claim (seconds since the epoch).
+func (c Claims) numericDate(name string) (time.Time, bool) {
+    switch v := c[name].(type) {
+    case float64:
+        return time.Unix(int64(v), 0), true
+    case json.Number:
+        if f, err := v.Float64(); err == nil {
+            return time.Unix(int64(f), 0), true
+        }
+    case string:
+        if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+            return time.Unix(n, 0), true
+        }
+    }
+    return time.Time{}, false
+}
+
+// IssuedAt returns the iat claim.
+func (c Claims) IssuedAt() (time.Time, bool) { return c.numericDate("iat") }
+
+// AuthTime returns the auth_time claim: when the user last authenticated.
+func (c Claims) AuthTime() (time.Time, bool) { return c.numericDate("auth_time") }
+
+// validateTimes checks exp, nbf and iat with the configured leeway. jwt/v4
+// has no leeway option, so parsing skips its own time checks and uses this.
+func (a *Auth) validateTimes(m jwt.MapClaims) error {
+    c := Claims(m)
+    now := time.Now()
+    if exp, ok := c.numericDate("exp"); ok && !now.Before(exp.Add(a.leeway)) {
+        return tokenError(ReasonExpired, ErrTokenExpired, fmt.Errorf("expired at %s", exp.UTC().Format(time.RFC3339)))
+    }
+    if nbf, ok := c.numericDate("nbf"); ok && now.Add(a.leeway).Before(nbf) {
+        return tokenError(ReasonNotYetValid, ErrTokenExpired, fmt.Errorf("not valid before %s", nbf.UTC().Format(time.RFC3339)))
+    }
+    if iat, ok := c.numericDate("iat"); ok && now.Add(a.leeway).Before(iat) {
+        return tokenError(ReasonNotYetValid, ErrTokenExpired, fmt.Errorf("issued in the future at %s", iat.UTC().Format(time.RFC3339)))
+    }
+    return nil
+}
+
+// Freshness limits how old a token, or the login behind it, may be.
+// Zero values disable the respective check.
+type Freshness struct {
+    MaxTokenAge time.Duration // based on iat; tokens without iat are rejected
+    MaxAuthAge  time.Duration // based on auth_time (OIDC max_age); for sensitive routes
+}
+
+// RequireFresh enforces f on a route group. Run it after Middleware.
+func (a *Auth) RequireFresh(f Freshness) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        claims, ok := FromContext(c)
+        if !ok {
+            abortMissingToken(c, "no auth context")
+            return
+        }
+        now := time.Now()
+        if f.MaxTokenAge > 0 {
+            iat, ok := claims.IssuedAt()
+            if !ok || now.Sub(iat) > f.MaxTokenAge+a.leeway {
+                abortInvalidToken(c, tokenError(ReasonTokenTooOld, ErrTokenTooOld, fmt.Errorf("iat %v exceeds max age %s", claims["iat"], f.MaxTokenAge)))
+                return
+            }
+        }
+        if f.MaxAuthAge > 0 {
+            at, ok := claims.AuthTime()
+            if !ok || now.Sub(at) > f.MaxAuthAge+a.leeway {
+                abortReauthenticate(c, ReasonAuthTooOld, "authentication is too old", "", f.MaxAuthAge)
+                return
+            }
+        }
+        c.Next()
+    }
+}
+
+// abortReauthenticate asks the client to authenticate again (RFC 9470):
+// with a stronger method (acr) and/or more recently (max_age).
+func abortReauthenticate(c *gin.Context, reason, desc, acr string, maxAge time.Duration) {
+    recordFailure(c, reason, errors.New(desc))
+    params := []string{"error", "insufficient_user_authentication", "error_description", desc, "acr_values", acr}
+    extra := gin.H{}
+    if acr != "" {
+        extra["acr_values"] = acr
+    }
+    if maxAge > 0 {
+        secs := strconv.Itoa(int(maxAge / time.Second))
+        params = append(params, "max_age", secs)
+        extra["max_age"] = int(maxAge / time.Second)
+    }
+    c.Header("WWW-Authenticate", challenge(c, params...))
+    httperr.AbortCode(c, http.StatusUnauthorized, "insufficient_user_authentication", desc, extra)
+}
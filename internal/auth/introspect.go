@@ -0,0 +1,225 @@
+package auth
+
+import (
+    "container/list"
+    "context"
+    "crypto/sha256"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "maps"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// Introspection modes.
+const (
+    IntrospectOpaque = "opaque" // introspect only tokens that are not JWTs
+    IntrospectAlways = "always" // introspect every bearer token
+)
+
+// IntrospectionConfig configures RFC 7662 token introspection.
+type IntrospectionConfig struct {
+    Mode         string // opaque (default) or always
+    ClientID     string
+    ClientSecret string
+    Endpoint     string        // defaults to the discovered introspection_endpoint
+    CacheSize    int           // max cached tokens; defaults to 10000
+    NegativeTTL  time.Duration // how long inactive results are cached; defaults to 30s
+    MaxTTL       time.Duration // cap for active results without exp; defaults to 5m
+}
+
+// Introspector validates tokens at the issuer's introspection endpoint and
+// caches results (active until exp, inactive for NegativeTTL).
+type Introspector struct {
+    auth       *Auth
+    cfg        IntrospectionConfig
+    httpClient *http.Client
+    cache      *lruCache
+}
+
+// NewIntrospector builds an introspector for tokens issued to a.
+func NewIntrospector(a *Auth, cfg IntrospectionConfig) (*Introspector, error) {
+    if cfg.ClientID == "" || cfg.ClientSecret == "" {
+        return nil, errors.New("introspection requires client id and secret")
+    }
+    if cfg.Mode == "" {
+        cfg.Mode = IntrospectOpaque
+    }
+    if cfg.Mode != IntrospectOpaque && cfg.Mode != IntrospectAlways {
+        return nil, fmt.Errorf("invalid introspection mode %q", cfg.Mode)
+    }
+    if cfg.Endpoint == "" {
+        cfg.Endpoint = a.disc.IntrospectionEndpoint
+    }
+    if cfg.CacheSize <= 0 {
+        cfg.CacheSize = 10000
+    }
+    if cfg.NegativeTTL <= 0 {
+        cfg.NegativeTTL = 30 * time.Second
+    }
+    if cfg.MaxTTL <= 0 {
+        cfg.MaxTTL = 5 * time.Minute
+    }
+    return &Introspector{
+        auth:       a,
+        cfg:        cfg,
+        httpClient: &http.Client{Timeout: 10 * time.Second},
+        cache:      newLRUCache(cfg.CacheSize),
+    }, nil
+}
+
+// accessTokenTypes are the token_type values of access tokens (RFC 6749
+// §7.1 types and the RFC 8693 URI), compared case-insensitively.
+var accessTokenTypes = map[string]bool{
+    "bearer":       true,
+    "dpop":         true,
+    "access_token": true,
+    "urn:ietf:params:oauth:token-type:access_token": true,
+}
+
+// applies reports whether a token should be introspected.
+func (i *Introspector) applies(token string) bool {
+    return i.cfg.Mode == IntrospectAlways || strings.Count(token, ".") != 2
+}
+
+// Introspect returns the claims of an active access token. The result is a
+// copy, so callers may modify it.
+func (i *Introspector) Introspect(ctx context.Context, token string) (Claims, error) {
+    sum := sha256.Sum256([]byte(token))
+    key := string(sum[:])
+    if v, ok := i.cache.get(key); ok {
+        if v == nil {
+            return nil, tokenError(ReasonInactive, ErrTokenInactive, nil)
+        }
+        return maps.Clone(v), nil
+    }
+
+    m, err := i.call(ctx, token)
+    if err != nil {
+        // Transport/server errors are not cached.
+        return nil, tokenError(ReasonIntrospectionFailed, err, err)
+    }
+    if active, _ := m["active"].(bool); !active {
+        i.cache.put(key, nil, time.Now().Add(i.cfg.NegativeTTL))
+        return nil, tokenError(ReasonInactive, ErrTokenInactive, nil)
+    }
+    delete(m, "active")
+    // Refresh and ID tokens can introspect as active too; only access tokens
+    // may be used as bearer tokens.
+    if tt, ok := m["token_type"].(string); ok && !accessTokenTypes[strings.ToLower(tt)] {
+        i.cache.put(key, nil, time.Now().Add(i.cfg.NegativeTTL))
+        return nil, tokenError(ReasonInvalidClaims, ErrTokenInactive, fmt.Errorf("introspected token_type %q is not an access token", tt))
+    }
+    // Introspection responses carry the same registered claims as a JWT;
+    // iss may be omitted, in which case the endpoint is trusted.
+    if iss, _ := m["iss"].(string); iss != "" && !i.auth.validIssuer(iss) {
+        return nil, tokenError(ReasonWrongIssuer, ErrInvalidIssuer, fmt.Errorf("introspected issuer %q", iss))
+    }
+    mc := jwt.MapClaims(m)
+    // Like the JWT path, the configured audience must match; responses
+    // without aud are matched on the client the token was issued to.
+    if aud := i.auth.primary.audience; aud != "" {
+        clientID, _ := m["client_id"].(string)
+        if !mc.VerifyAudience(aud, true) && (m["aud"] != nil || clientID != aud) {
+            return nil, tokenError(ReasonWrongAudience, ErrInvalidAudience, fmt.Errorf("introspected audience %v, client_id %q", m["aud"], clientID))
+        }
+    }
+    if err := i.auth.validateTimes(mc); err != nil {
+        return nil, err
+    }
+
+    expires := time.Now().Add(i.cfg.MaxTTL)
+    if exp, ok := m["exp"].(float64); ok {
+        if t := time.Unix(int64(exp), 0); t.Before(expires) {
+            expires = t
+        }
+    }
+    claims := Claims(m)
+    i.cache.put(key, claims, expires)
+    return maps.Clone(claims), nil
+}
+
+func (i *Introspector) call(ctx context.Context, token string) (map[string]any, error) {
+    form := url.Values{}
+    form.Set("token", token)
+    form.Set("token_type_hint", "access_token")
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.cfg.Endpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    req.SetBasicAuth(url.QueryEscape(i.cfg.ClientID), url.QueryEscape(i.cfg.ClientSecret))
+    resp, err := i.httpClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("introspection: %w", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("introspection: status %d", resp.StatusCode)
+    }
+    var m map[string]any
+    dec := json.NewDecoder(resp.Body)
+    if err := dec.Decode(&m); err != nil {
+        return nil, fmt.Errorf("introspection: decode: %w", err)
+    }
+    return m, nil
+}
+
+// lruCache is a bounded, expiring LRU keyed by token hash. A nil value
+// records a negative (inactive) result.
+type lruCache struct {
+    mu    sync.Mutex
+    max   int
+    ll    *list.List
+    items map[string]*list.Element
+}
+
+type lruEntry struct {
+    key     string
+    claims  Claims
+    expires time.Time
+}
+
+func newLRUCache(max int) *lruCache {
+    return &lruCache{max: max, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lruCache) get(key string) (Claims, bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    el, ok := l.items[key]
+    if !ok {
+        return nil, false
+    }
+    e := el.Value.(*lruEntry)
+    if time.Now().After(e.expires) {
+        l.ll.Remove(el)
+        delete(l.items, key)
+        return nil, false
+    }
+    l.ll.MoveToFront(el)
+    return e.claims, true
+}
+
+func (l *lruCache) put(key string, claims Claims, expires time.Time) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if el, ok := l.items[key]; ok {
+        el.Value = &lruEntry{key: key, claims: claims, expires: expires}
+        l.ll.MoveToFront(el)
+        return
+    }
+    l.items[key] = l.ll.PushFront(&lruEntry{key: key, claims: claims, expires: expires})
+    for l.ll.Len() > l.max {
+        oldest := l.ll.Back()
+        l.ll.Remove(oldest)
+        delete(l.items, oldest.Value.(*lruEntry).key)
+    }
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+    "fmt"
+    "log"
+    "strings"
+)
+
+// IssuerPolicy controls which iss values are accepted for the trusted
+// issuers. Without it only the issuer reported by discovery (or configured
+// for additional issuers) is accepted, ignoring a trailing slash.
+type IssuerPolicy struct {
+    // Strict requires the token's iss to equal an accepted issuer string
+    // byte for byte; trailing-slash tolerance and aliases are disabled.
+    Strict bool
+    // Allow lists extra exact issuer strings accepted for the primary issuer.
+    Allow []string
+    // Aliases maps an alternate issuer string to the canonical issuer it
+    // stands for, e.g. the sts.asgardeo.io form of an api.asgardeo.io issuer.
+    Aliases map[string]string
+}
+
+// ParseIssuerAliases parses "alias=>canonical,alias2=>canonical2".
+func ParseIssuerAliases(spec string) (map[string]string, error) {
+    out := map[string]string{}
+    for _, pair := range strings.Split(spec, ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        alias, canonical, ok := strings.Cut(pair, "=>")
+        alias, canonical = strings.TrimSpace(alias), strings.TrimSpace(canonical)
+        if !ok || alias == "" || canonical == "" {
+            return nil, fmt.Errorf("issuer alias %q: want alias=>canonical", pair)
+        }
+        out[alias] = canonical
+    }
+    return out, nil
+}
+
+// SetIssuerPolicy replaces the issuer acceptance rules.
+func (a *Auth) SetIssuerPolicy(p IssuerPolicy) {
+    a.issuerPolicy = p
+}
+
+// accepted returns the exact issuer strings accepted for t.
+func (a *Auth) accepted(t *trustedIssuer) []string {
+    out := []string{t.issuer}
+    if t == a.primary {
+        out = append(out, a.issuerPolicy.Allow...)
+    }
+    return out
+}
+
+// issuerAccepts reports whether iss is acceptable for trusted issuer t.
+func (a *Auth) issuerAccepts(t *trustedIssuer, iss string) bool {
+    if iss == "" {
+        return false
+    }
+    if a.issuerPolicy.Strict {
+        for _, s := range a.accepted(t) {
+            if iss == s {
+                return true
+            }
+        }
+        return false
+    }
+    got := strings.TrimRight(iss, "/")
+    for alias, canonical := range a.issuerPolicy.Aliases {
+        if got == strings.TrimRight(alias, "/") {
+            got = strings.TrimRight(canonical, "/")
+            break
+        }
+    }
+    for _, s := range a.accepted(t) {
+        if got == strings.TrimRight(s, "/") {
+            return true
+        }
+    }
+    return false
+}
+
+// LogIssuerPolicy writes the effective issuer policy to the log so security
+// reviews can see exactly which iss values are accepted.
+func (a *Auth) LogIssuerPolicy() {
+    mode := "lenient (trailing slash ignored, aliases applied)"
+    if a.issuerPolicy.Strict {
+        mode = "strict (exact match only)"
+    }
+    log.Printf("issuer policy: %s", mode)
+    for _, t := range a.issuers {
+        log.Printf("issuer policy: %s accepts %q", t.name, a.accepted(t))
+    }
+    if len(a.issuerPolicy.Aliases) > 0 {
+        if a.issuerPolicy.Strict {
+            log.Printf("issuer policy: %d alias rule(s) ignored in strict mode", len(a.issuerPolicy.Aliases))
+        } else {
+            for alias, canonical := range a.issuerPolicy.Aliases {
+                log.Printf("issuer policy: alias %q => %q", alias, canonical)
+            }
+        }
+    }
+}
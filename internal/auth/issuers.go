@@ -0,0 +1,212 @@
+package auth
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/MicahParks/keyfunc"
+    jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// IssuerConfig describes an additional identity provider whose tokens are
+// accepted, e.g. a second Asgardeo tenant or Firebase for legacy passengers.
+type IssuerConfig struct {
+    Name     string            `json:"name"`     // label for logs
+    Issuer   string            `json:"issuer"`   // expected iss value
+    Audience string            `json:"audience"` // required expected aud
+    JWKSURI  string            `json:"jwks_uri"` // optional; discovered from the issuer when empty
+    ClaimMap map[string]string `json:"claims"`   // our claim name -> the issuer's claim name
+}
+
+// trustedIssuer is one identity provider with its own keys and checks.
+type trustedIssuer struct {
+    name     string
+    issuer   string
+    audience string // optional for the primary issuer only
+    jwks     *keyfunc.JWKS
+    claimMap map[string]string
+}
+
+// ParseIssuerConfigs decodes a JSON array of IssuerConfig (TRUSTED_ISSUERS).
+// Every entry needs an audience: issuers such as Google's are shared by many
+// clients, and without the check any of their tokens would be accepted.
+func ParseIssuerConfigs(raw string) ([]IssuerConfig, error) {
+    if strings.TrimSpace(raw) == "" {
+        return nil, nil
+    }
+    var out []IssuerConfig
+    if err := json.Unmarshal([]byte(raw), &out); err != nil {
+        return nil, fmt.Errorf("trusted issuers: %w", err)
+    }
+    for i, ic := range out {
+        if ic.Issuer == "" {
+            return nil, fmt.Errorf("trusted issuers: entry %d has no issuer", i)
+        }
+        if ic.Audience == "" {
+            return nil, fmt.Errorf("trusted issuers: entry %d (%s) has no audience", i, ic.Issuer)
+        }
+    }
+    return out, nil
+}
+
+// AddIssuer trusts an additional issuer. Tokens are routed to it by their
+// iss claim before signature verification. The audience is required.
+func (a *Auth) AddIssuer(cfg IssuerConfig) error {
+    if cfg.Issuer == "" {
+        return errors.New("issuer is required")
+    }
+    if cfg.Audience == "" {
+        return fmt.Errorf("issuer %s: audience is required", cfg.Issuer)
+    }
+    t, _, err := loadIssuer(cfg, a.cacheMinutes)
+    if err != nil {
+        return fmt.Errorf("issuer %s: %w", cfg.Issuer, err)
+    }
+    a.issuers = append(a.issuers, t)
+    return nil
+}
+
+// Issuers lists the accepted issuers, primary first.
+func (a *Auth) Issuers() []string {
+    out := make([]string, 0, len(a.issuers))
+    for _, t := range a.issuers {
+        out = append(out, t.issuer)
+    }
+    return out
+}
+
+// issuerFor returns the trusted issuer matching iss, if any.
+func (a *Auth) issuerFor(iss string) *trustedIssuer {
+    for _, t := range a.issuers {
+        if a.issuerAccepts(t, iss) {
+            return t
+        }
+    }
+    return nil
+}
+
+// UserIssuer returns the issuer that namespaces the subject of claims in
+// the users table and the denylist: "" for the primary issuer (and for
+// introspected tokens, which it issued), otherwise the trusted issuer's iss.
+// The same sub from two issuers is two different people.
+func (a *Auth) UserIssuer(claims Claims) string {
+    iss, _ := claims["iss"].(string)
+    if iss == "" {
+        return ""
+    }
+    t := a.issuerFor(iss)
+    if t == nil {
+        return strings.TrimRight(iss, "/")
+    }
+    if t == a.primary {
+        return ""
+    }
+    return t.issuer
+}
+
+// SubjectKey identifies a user across issuers: the bare sub for the primary
+// issuer, issuer#sub otherwise.
+func SubjectKey(issuer, sub string) string {
+    if issuer == "" {
+        return sub
+    }
+    return issuer + "#" + sub
+}
+
+// loadIssuer discovers (when needed) and loads the JWKS for an issuer.
+func loadIssuer(cfg IssuerConfig, cacheMinutes int) (*trustedIssuer, discoveryDoc, error) {
+    // Normalize issuer: trim trailing slash for consistency
+    iss := strings.TrimRight(cfg.Issuer, "/")
+
+    var dd discoveryDoc
+    if cfg.JWKSURI != "" {
+        dd.Issuer = iss
+        dd.JWKSURI = cfg.JWKSURI
+    } else {
+        // Fetch discovery (with fallback to issuer + "/jwks")
+        discURL := iss + "/.well-known/openid-configuration"
+        req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, discURL, nil)
+        resp, err := http.DefaultClient.Do(req)
+        if err == nil && resp != nil {
+            defer resp.Body.Close()
+            if resp.StatusCode == http.StatusOK {
+                _ = json.NewDecoder(resp.Body).Decode(&dd)
+            }
+        }
+        // Fallback if jwks_uri missing
+        if dd.JWKSURI == "" {
+            dd.Issuer = iss
+            dd.JWKSURI = iss + "/jwks"
+        }
+    }
+
+    // Prefer the issuer value reported by discovery when available.
+    if dd.Issuer != "" {
+        iss = strings.TrimRight(dd.Issuer, "/")
+    }
+
+    // Build JWKS with background refresh
+    refreshInt := time.Duration(cacheMinutes) * time.Minute
+    if refreshInt <= 0 {
+        refreshInt = 60 * time.Minute
+    }
+    jwks, err := keyfunc.Get(dd.JWKSURI, keyfunc.Options{
+        RefreshErrorHandler: func(err error) {
+            // no-op logging; could integrate with a real logger
+        },
+        RefreshInterval: refreshInt,
+        RefreshTimeout:  10 * time.Second,
+        // Follow any headers recommending refresh
+        RefreshUnknownKID: true,
+    })
+    if err != nil {
+        return nil, dd, fmt.Errorf("load jwks: %w", err)
+    }
+
+    name := cfg.Name
+    if name == "" {
+        name = iss
+    }
+    return &trustedIssuer{
+        name:     name,
+        issuer:   iss,
+        audience: cfg.Audience,
+        jwks:     jwks,
+        claimMap: cfg.ClaimMap,
+    }, dd, nil
+}
+
+// validateClaims checks issuer, audience (optional), and time-based claims
+// (with leeway).
+func (a *Auth) validateClaims(t *trustedIssuer, m jwt.MapClaims) error {
+    issClaim, _ := m["iss"].(string)
+    if !a.issuerAccepts(t, issClaim) {
+        return tokenError(ReasonWrongIssuer, ErrInvalidIssuer, fmt.Errorf("issuer %q not accepted for %s", issClaim, t.name))
+    }
+    if t.audience != "" && !m.VerifyAudience(t.audience, true) {
+        return tokenError(ReasonWrongAudience, ErrInvalidAudience, fmt.Errorf("audience %v, want %q", m["aud"], t.audience))
+    }
+    if err := a.validateTimes(m); err != nil {
+        return err
+    }
+    return nil
+}
+
+// mapClaims copies issuer-specific claims onto the names our handlers use
+// (e.g. Firebase "user_id" -> "sub"), without overwriting existing values.
+func (t *trustedIssuer) mapClaims(c Claims) Claims {
+    for dst, src := range t.claimMap {
+        if _, exists := c[dst]; exists {
+            continue
+        }
+        if v, ok := c[src]; ok {
+            c[dst] = v
+        }
+    }
+    return c
+}
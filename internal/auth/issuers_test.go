@@ -0,0 +1,24 @@
+package auth
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestAdditionalIssuersRequireAudience(t *testing.T) {
+    if _, err := ParseIssuerConfigs(`[{"name":"firebase","issuer":"https://securetoken.google.com/legacy"}]`); err == nil || !strings.Contains(err.Error(), "audience") {
+        t.Errorf("ParseIssuerConfigs without audience: err = %v", err)
+    }
+    cfgs, err := ParseIssuerConfigs(`[{"name":"firebase","issuer":"https://securetoken.google.com/legacy","audience":"legacy"}]`)
+    if err != nil || len(cfgs) != 1 || cfgs[0].Audience != "legacy" {
+        t.Errorf("ParseIssuerConfigs = %+v, %v", cfgs, err)
+    }
+
+    a := &Auth{}
+    if err := a.AddIssuer(IssuerConfig{Issuer: "https://accounts.google.com"}); err == nil || !strings.Contains(err.Error(), "audience") {
+        t.Errorf("AddIssuer without audience: err = %v", err)
+    }
+    if len(a.Issuers()) != 0 {
+        t.Errorf("issuer without audience was trusted: %v", a.Issuers())
+    }
+}
@@ -2,7 +2,7 @@ package auth
 
 import (
     "context"
-    "encoding/json"
+    "crypto/subtle"
     "errors"
     "fmt"
     "net/http"
@@ -12,21 +12,32 @@ import (
 
     "github.com/gin-gonic/gin"
     jwt "github.com/golang-jwt/jwt/v4"
-    "github.com/MicahParks/keyfunc"
+
+    "smart-transit-system/internal/httperr"
 )
 
 // Auth holds the verification state and configuration.
 type Auth struct {
-    issuer   string
-    audience string // optional
-    jwks     *keyfunc.JWKS
-    once     sync.Once
-    tenant   string // extracted from issuer path (/t/{tenant}) for tolerant checks
+    primary      *trustedIssuer   // the Asgardeo issuer used for login, ID tokens and introspection
+    issuers      []*trustedIssuer // all accepted issuers, primary first
+    cacheMinutes int
+    issuerPolicy IssuerPolicy
+    leeway       time.Duration // clock skew tolerated on exp/nbf/iat
+    once         sync.Once
+    disc         discoveryDoc
+    sessions     *Sessions     // optional BFF session cookies
+    introspector *Introspector // optional RFC 7662 introspection for opaque tokens
+    dpop         *DPoP         // optional RFC 9449 sender-constrained tokens
+    revocations  *Revocations  // optional local denylist
 }
 
 type discoveryDoc struct {
-    Issuer  string `json:"issuer"`
-    JWKSURI string `json:"jwks_uri"`
+    Issuer                string `json:"issuer"`
+    JWKSURI               string `json:"jwks_uri"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    IntrospectionEndpoint string `json:"introspection_endpoint"`
+    EndSessionEndpoint    string `json:"end_session_endpoint"`
 }
 
 // New creates an Auth instance by discovering the JWKS from the issuer.
@@ -34,66 +45,43 @@ func New(issuer string, audience string, cacheMinutes int) (*Auth, error) {
     if issuer == "" {
         return nil, errors.New("issuer is required")
     }
-
-    // Normalize issuer: trim trailing slash for consistency
-    iss := strings.TrimRight(issuer, "/")
-    discURL := iss + "/.well-known/openid-configuration"
-
-    // Fetch discovery (with fallback to issuer + "/jwks")
-    var dd discoveryDoc
-    req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, discURL, nil)
-    resp, err := http.DefaultClient.Do(req)
-    if err == nil && resp != nil {
-        defer resp.Body.Close()
-        if resp.StatusCode == http.StatusOK {
-            if decErr := json.NewDecoder(resp.Body).Decode(&dd); decErr == nil && dd.JWKSURI != "" {
-                // ok
-            }
-        }
-    }
-    // Fallback if jwks_uri missing
-    if dd.JWKSURI == "" {
-        dd.Issuer = iss
-        dd.JWKSURI = iss + "/jwks"
+    t, dd, err := loadIssuer(IssuerConfig{Issuer: issuer, Audience: audience}, cacheMinutes)
+    if err != nil {
+        return nil, err
     }
 
-    // Prefer the issuer value reported by discovery when available.
-    if dd.Issuer != "" {
-        iss = strings.TrimRight(dd.Issuer, "/")
+    // Fallback endpoints follow the Asgardeo layout (<issuer>/authorize, <issuer>/token)
+    base := strings.TrimRight(issuer, "/")
+    if dd.AuthorizationEndpoint == "" {
+        dd.AuthorizationEndpoint = base + "/authorize"
     }
-
-    // Build JWKS with background refresh
-    refreshInt := time.Duration(cacheMinutes) * time.Minute
-    if refreshInt <= 0 {
-        refreshInt = 60 * time.Minute
+    if dd.TokenEndpoint == "" {
+        dd.TokenEndpoint = base + "/token"
     }
-    jwks, err := keyfunc.Get(dd.JWKSURI, keyfunc.Options{
-        RefreshErrorHandler: func(err error) {
-            // no-op logging; could integrate with a real logger
-        },
-        RefreshInterval: refreshInt,
-        RefreshTimeout:  10 * time.Second,
-        // Follow any headers recommending refresh
-        RefreshUnknownKID: true,
-    })
-    if err != nil {
-        return nil, fmt.Errorf("load jwks: %w", err)
+    if dd.IntrospectionEndpoint == "" {
+        dd.IntrospectionEndpoint = base + "/introspect"
     }
-
-    // Extract tenant from issuer path (first segment after /t/)
-    tenant := ""
-    if i := strings.Index(iss, "/t/"); i >= 0 {
-        rest := iss[i+3:]
-        if j := strings.Index(rest, "/"); j >= 0 {
-            tenant = rest[:j]
-        } else {
-            tenant = rest
-        }
+    // Asgardeo serves RP-initiated logout at <tenant>/oidc/logout
+    if dd.EndSessionEndpoint == "" && strings.HasSuffix(base, "/oauth2/token") {
+        dd.EndSessionEndpoint = strings.TrimSuffix(base, "/oauth2/token") + "/oidc/logout"
     }
 
-    return &Auth{issuer: iss, audience: audience, jwks: jwks, tenant: tenant}, nil
+    return &Auth{primary: t, issuers: []*trustedIssuer{t}, cacheMinutes: cacheMinutes, leeway: DefaultLeeway, disc: dd}, nil
 }
 
+// Issuer returns the effective issuer used for token validation.
+func (a *Auth) Issuer() string { return a.primary.issuer }
+
+// AuthorizationEndpoint returns the discovered authorize endpoint.
+func (a *Auth) AuthorizationEndpoint() string { return a.disc.AuthorizationEndpoint }
+
+// TokenEndpoint returns the discovered token endpoint.
+func (a *Auth) TokenEndpoint() string { return a.disc.TokenEndpoint }
+
+// EndSessionEndpoint returns the discovered RP-initiated logout endpoint
+// ("" when the IdP has none).
+func (a *Auth) EndSessionEndpoint() string { return a.disc.EndSessionEndpoint }
+
 // Claims is a permissive map of token claims with helpers.
 type Claims map[string]any
 
@@ -110,6 +98,36 @@ func (c Claims) Email() string {
     return ""
 }
 
+// EmailVerified reports whether the issuer vouches for the email claim
+// (email_verified true, as a boolean or the string "true").
+func (c Claims) EmailVerified() bool {
+    switch v := c["email_verified"].(type) {
+    case bool:
+        return v
+    case string:
+        return strings.EqualFold(v, "true")
+    }
+    return false
+}
+func (c Claims) GivenName() string {
+    if v, ok := c["given_name"].(string); ok {
+        return v
+    }
+    return ""
+}
+func (c Claims) FamilyName() string {
+    if v, ok := c["family_name"].(string); ok {
+        return v
+    }
+    return ""
+}
+func (c Claims) PhoneNumber() string {
+    if v, ok := c["phone_number"].(string); ok {
+        return v
+    }
+    return ""
+}
+
 func (c Claims) Scopes() []string {
     // scope as space-delimited string
     if v, ok := c["scope"].(string); ok && v != "" {
@@ -131,6 +149,19 @@ func (c Claims) Scopes() []string {
     return nil
 }
 
+// Groups returns the groups claim (Asgardeo puts Internal/... and
+// Application/... role names there).
+func (c Claims) Groups() []string {
+    arr, _ := c["groups"].([]any)
+    out := make([]string, 0, len(arr))
+    for _, x := range arr {
+        if s, ok := x.(string); ok {
+            out = append(out, s)
+        }
+    }
+    return out
+}
+
 func (c Claims) Roles() []string {
     // roles as array
     if arr, ok := c["roles"].([]any); ok {
@@ -171,85 +202,153 @@ func (c Claims) Roles() []string {
     return nil
 }
 
-// Middleware verifies the bearer token and injects claims into context.
+// UseIntrospection enables RFC 7662 token introspection.
+func (a *Auth) UseIntrospection(i *Introspector) { a.introspector = i }
+
+// UseSessions enables authenticating requests by BFF session cookie when
+// no Authorization header is present.
+func (a *Auth) UseSessions(s *Sessions) { a.sessions = s }
+
+// Middleware verifies the bearer token (or BFF session cookie) and injects
+// claims into context.
 func (a *Auth) Middleware() gin.HandlerFunc {
     return func(c *gin.Context) {
         authz := c.GetHeader("Authorization")
-        if authz == "" || !strings.HasPrefix(strings.ToLower(authz), "bearer ") {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
-            return
-        }
-        tokenStr := strings.TrimSpace(authz[len("Bearer "):])
-
-        parser := &jwt.Parser{ValidMethods: []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}}
-        parsed, err := parser.Parse(tokenStr, a.jwks.Keyfunc)
-        if err != nil || !parsed.Valid {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+        var tokenStr string
+        isDPoP := false
+        switch {
+        case authz != "" && strings.HasPrefix(strings.ToLower(authz), "bearer "):
+            tokenStr = strings.TrimSpace(authz[len("Bearer "):])
+        case authz != "" && a.dpop != nil && strings.HasPrefix(strings.ToLower(authz), "dpop "):
+            tokenStr = strings.TrimSpace(authz[len("DPoP "):])
+            isDPoP = true
+        case authz == "" && a.sessions != nil && a.sessions.HasCookie(c):
+            tok, err := a.sessions.AccessToken(c)
+            if errors.Is(err, ErrCSRF) {
+                recordFailure(c, ReasonCSRF, err)
+                httperr.AbortCode(c, http.StatusForbidden, "invalid_csrf_token", "invalid csrf token", nil)
+                return
+            }
+            if err != nil {
+                recordFailure(c, ReasonInvalidSession, err)
+                httperr.AbortCode(c, http.StatusUnauthorized, "invalid_session", "invalid session", nil)
+                return
+            }
+            tokenStr = tok
+        default:
+            abortMissingToken(c, "missing bearer token")
             return
         }
 
-        // Extract claims into map
-        m, ok := parsed.Claims.(jwt.MapClaims)
-        if !ok {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid claims"})
-            return
-        }
-        // Validate issuer, audience (optional), and time-based claims
-        // Issuer check with tolerance for trailing slash differences
-        issClaim, _ := m["iss"].(string)
-        expected := strings.TrimRight(a.issuer, "/")
-        got := strings.TrimRight(issClaim, "/")
-        // Normalize to tolerate trailing slash, optional /oauth2 or /oidc segment,
-        // and host aliases (api/sts). Also accept any issuer that clearly targets
-        // the same tenant (/t/{tenant}).
-        canon := func(s string) string {
-            s = strings.TrimSpace(s)
-            s = strings.TrimRight(s, "/")
-            s = strings.TrimSuffix(s, "/oauth2")
-            s = strings.TrimSuffix(s, "/oidc")
-            s = strings.ReplaceAll(s, "api.asgardeo.io", "asgardeo.io")
-            s = strings.ReplaceAll(s, "sts.asgardeo.io", "asgardeo.io")
-            return s
+        claims, err := a.verifyAccessToken(c.Request.Context(), tokenStr)
+        if err == nil {
+            err = a.checkBinding(c, claims, tokenStr, isDPoP)
         }
-        eg := canon(expected)
-        gg := canon(got)
-        valid := eg != "" && gg == eg
-        if !valid && a.tenant != "" {
-            // Tenant-aware relaxed check
-            // Accept if token issuer contains /t/{tenant} after canonicalization.
-            if strings.Contains(gg, "/t/"+a.tenant) {
-                valid = true
-            }
-        }
-        if !valid {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid issuer"})
-            return
-        }
-        if a.audience != "" && !m.VerifyAudience(a.audience, true) {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid audience"})
-            return
+        issuer := a.UserIssuer(claims)
+        if err == nil && a.revocations != nil {
+            err = a.revocations.check(claims, issuer)
         }
-        if err := m.Valid(); err != nil {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "expired or not yet valid"})
+        if err != nil {
+            abortInvalidToken(c, err)
             return
         }
-
-        claims := Claims(m)
         c.Set(ContextClaimsKey, claims)
+        c.Set(ContextPrincipalKey, principalFor(claims, issuer))
         c.Next()
     }
 }
 
+// checkBinding enforces sender constraints: certificate-bound tokens
+// (cnf.x5t#S256) need the matching client certificate, a DPoP-scheme request
+// needs a valid proof for the key the token is bound to (cnf.jkt), and a
+// DPoP-bound token must not be used as a plain bearer token.
+func (a *Auth) checkBinding(c *gin.Context, claims Claims, tokenStr string, isDPoP bool) error {
+    if err := checkCertBinding(c, claims); err != nil {
+        return err
+    }
+    jkt := claims.confirmationJKT()
+    if !isDPoP {
+        if jkt != "" {
+            return tokenError(ReasonDPoPBinding, ErrTokenIsBound, errors.New("cnf.jkt token sent as bearer"))
+        }
+        return nil
+    }
+    proofJKT, err := a.dpop.verify(c, tokenStr)
+    if err != nil {
+        return err
+    }
+    if jkt == "" || subtle.ConstantTimeCompare([]byte(jkt), []byte(proofJKT)) != 1 {
+        return tokenError(ReasonDPoPBinding, ErrDPoPBinding, fmt.Errorf("cnf.jkt %q, proof key %q", jkt, proofJKT))
+    }
+    return nil
+}
+
+// Token validation failures; the messages are returned to clients. The
+// validation functions wrap them in a *TokenError carrying the reason.
+var (
+    ErrInvalidToken    = errors.New("invalid token")
+    ErrInvalidClaims   = errors.New("invalid claims")
+    ErrInvalidIssuer   = errors.New("invalid issuer")
+    ErrInvalidAudience = errors.New("invalid audience")
+    ErrTokenExpired    = errors.New("expired or not yet valid")
+    ErrTokenInactive   = errors.New("token is not active")
+)
+
+// verifyAccessToken validates an access token and returns its claims.
+// Opaque tokens (or all tokens, depending on the mode) go through
+// introspection when it is configured; everything else is verified as a JWT.
+func (a *Auth) verifyAccessToken(ctx context.Context, tokenStr string) (Claims, error) {
+    if a.introspector != nil && a.introspector.applies(tokenStr) {
+        return a.introspector.Introspect(ctx, tokenStr)
+    }
+    return a.verifyJWT(tokenStr)
+}
+
+// verifyJWT selects the trusted issuer named by the token's (unverified)
+// iss claim, then checks signature (via that issuer's JWKS), issuer,
+// audience and time claims, and applies the issuer's claim mapping.
+func (a *Auth) verifyJWT(tokenStr string) (Claims, error) {
+    parser := &jwt.Parser{ValidMethods: []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}, SkipClaimsValidation: true}
+    var unverified jwt.MapClaims
+    if _, _, err := parser.ParseUnverified(tokenStr, &unverified); err != nil {
+        return nil, tokenError(ReasonMalformed, ErrInvalidToken, err)
+    }
+    iss, _ := unverified["iss"].(string)
+    t := a.issuerFor(iss)
+    if t == nil {
+        return nil, tokenError(ReasonWrongIssuer, ErrInvalidIssuer, fmt.Errorf("untrusted issuer %q", iss))
+    }
+
+    parsed, err := parser.Parse(tokenStr, t.jwks.Keyfunc)
+    if err != nil {
+        return nil, classifyJWTError(err)
+    }
+    if !parsed.Valid {
+        return nil, tokenError(ReasonMalformed, ErrInvalidToken, nil)
+    }
+
+    // Extract claims into map
+    m, ok := parsed.Claims.(jwt.MapClaims)
+    if !ok {
+        return nil, tokenError(ReasonInvalidClaims, ErrInvalidClaims, nil)
+    }
+    if err := a.validateClaims(t, m); err != nil {
+        return nil, err
+    }
+    return t.mapClaims(Claims(m)), nil
+}
+
+// validIssuer checks a token issuer against the primary issuer.
+func (a *Auth) validIssuer(issClaim string) bool {
+    return a.issuerAccepts(a.primary, issClaim)
+}
+
 // RequireScopes ensures the token has all required scopes.
 func RequireScopes(required ...string) gin.HandlerFunc {
-    reqSet := make(map[string]struct{}, len(required))
-    for _, s := range required {
-        reqSet[s] = struct{}{}
-    }
     return func(c *gin.Context) {
         val, ok := c.Get(ContextClaimsKey)
         if !ok {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "no auth context"})
+            abortMissingToken(c, "no auth context")
             return
         }
         claims, _ := val.(Claims)
@@ -257,9 +356,9 @@ func RequireScopes(required ...string) gin.HandlerFunc {
         for _, s := range claims.Scopes() {
             got[s] = struct{}{}
         }
-        for s := range reqSet {
+        for _, s := range required {
             if _, ok := got[s]; !ok {
-                c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing scope: " + s})
+                abortInsufficientScope(c, s, required)
                 return
             }
         }
@@ -0,0 +1,81 @@
+package auth
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "os"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ErrCertBinding is returned when a certificate-bound token (RFC 8705) is
+// not presented over a connection with the matching client certificate.
+var ErrCertBinding = errors.New("client certificate does not match token binding")
+
+// ServerTLSConfig builds the TLS config for terminating TLS with client
+// certificate verification against the CA bundle at caFile. With require
+// false, clients without a certificate (browsers) can still connect and are
+// only restricted when their token is certificate-bound.
+func ServerTLSConfig(caFile string, require bool) (*tls.Config, error) {
+    pem, err := os.ReadFile(caFile)
+    if err != nil {
+        return nil, fmt.Errorf("client ca bundle: %w", err)
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pem) {
+        return nil, fmt.Errorf("client ca bundle %s: no certificates found", caFile)
+    }
+    mode := tls.VerifyClientCertIfGiven
+    if require {
+        mode = tls.RequireAndVerifyClientCert
+    }
+    return &tls.Config{
+        ClientCAs:  pool,
+        ClientAuth: mode,
+        MinVersion: tls.VersionTLS12,
+    }, nil
+}
+
+// confirmationX5T returns the cnf.x5t#S256 certificate thumbprint a token is
+// bound to.
+func (c Claims) confirmationX5T() string {
+    cnf, _ := c["cnf"].(map[string]any)
+    s, _ := cnf["x5t#S256"].(string)
+    return s
+}
+
+// ClientCertificate returns the verified client certificate of the
+// connection, if any.
+func ClientCertificate(c *gin.Context) *x509.Certificate {
+    if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 || len(c.Request.TLS.PeerCertificates) == 0 {
+        return nil
+    }
+    return c.Request.TLS.PeerCertificates[0]
+}
+
+// certThumbprint is the base64url SHA-256 of the DER certificate.
+func certThumbprint(cert *x509.Certificate) string {
+    sum := sha256.Sum256(cert.Raw)
+    return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// checkCertBinding enforces RFC 8705 certificate-bound access tokens.
+func checkCertBinding(c *gin.Context, claims Claims) error {
+    want := claims.confirmationX5T()
+    if want == "" {
+        return nil
+    }
+    cert := ClientCertificate(c)
+    if cert == nil {
+        return tokenError(ReasonCertBinding, ErrCertBinding, errors.New("certificate-bound token without a verified client certificate"))
+    }
+    if got := certThumbprint(cert); subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+        return tokenError(ReasonCertBinding, ErrCertBinding, fmt.Errorf("cnf.x5t#S256 %q, certificate %q (%s)", want, got, cert.Subject))
+    }
+    return nil
+}
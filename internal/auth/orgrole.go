@@ -0,0 +1,126 @@
+package auth
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+
+    "smart-transit-system/internal/httperr"
+    "smart-transit-system/internal/models"
+)
+
+const contextOrgRolesKey = "authOrgRoles"
+
+// OrgRoles resolves the caller's org-scoped roles from user_org_memberships.
+type OrgRoles struct {
+    db *gorm.DB
+}
+
+// NewOrgRoles builds an org role resolver backed by the memberships table.
+func NewOrgRoles(db *gorm.DB) *OrgRoles {
+    return &OrgRoles{db: db}
+}
+
+// Role returns the caller's role in orgID ("" when not a member). Lookups
+// are cached in the gin context so several checks in one request hit the
+// database once per org.
+func (o *OrgRoles) Role(c *gin.Context, orgID string) (string, error) {
+    cache, _ := c.Get(contextOrgRolesKey)
+    roles, _ := cache.(map[string]string)
+    if roles == nil {
+        roles = make(map[string]string)
+        c.Set(contextOrgRolesKey, roles)
+    }
+    if r, ok := roles[orgID]; ok {
+        return r, nil
+    }
+
+    userID, err := o.userID(c)
+    if err != nil {
+        return "", err
+    }
+    role := ""
+    if userID != "" {
+        var m models.UserOrgMembership
+        err := o.db.WithContext(c.Request.Context()).
+            Where("user_id = ? AND org_id = ?", userID, orgID).
+            First(&m).Error
+        switch {
+        case err == nil:
+            role = m.Role
+        case errors.Is(err, gorm.ErrRecordNotFound), strings.Contains(err.Error(), "SQLSTATE 22P02"):
+            // not a member, or the org id is not a valid uuid
+        default:
+            return "", fmt.Errorf("load membership: %w", err)
+        }
+    }
+    roles[orgID] = role
+    return role, nil
+}
+
+// userID resolves the caller's local user id, preferring the one set by
+// Provision and falling back to a lookup by issuer and sub.
+func (o *OrgRoles) userID(c *gin.Context) (string, error) {
+    if id, ok := UserIDFromContext(c); ok {
+        return id, nil
+    }
+    p, ok := PrincipalFromContext(c)
+    if !ok || p.IsService() || p.Subject == "" {
+        return "", nil
+    }
+    var u models.User
+    err := o.db.WithContext(c.Request.Context()).Select("id").Where("issuer = ? AND sub = ?", p.Issuer, p.Subject).First(&u).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return "", nil
+    }
+    if err != nil {
+        return "", fmt.Errorf("load user: %w", err)
+    }
+    c.Set(ContextUserIDKey, u.ID)
+    return u.ID, nil
+}
+
+// HasRole reports whether the caller holds one of roles in orgID.
+func (o *OrgRoles) HasRole(c *gin.Context, orgID string, roles ...string) (bool, error) {
+    got, err := o.Role(c, orgID)
+    if err != nil || got == "" {
+        return false, err
+    }
+    for _, r := range roles {
+        if r == got {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+// RequireOrgRole ensures the caller holds one of roles in the org whose id
+// is in the named route parameter.
+func (o *OrgRoles) RequireOrgRole(param string, roles ...string) gin.HandlerFunc {
+    want := strings.Join(roles, " or ")
+    return func(c *gin.Context) {
+        if _, ok := FromContext(c); !ok {
+            httperr.Abort(c, http.StatusUnauthorized, "no auth context")
+            return
+        }
+        orgID := c.Param(param)
+        if orgID == "" {
+            httperr.Abort(c, http.StatusBadRequest, "missing organization id")
+            return
+        }
+        ok, err := o.HasRole(c, orgID, roles...)
+        if err != nil {
+            httperr.Abort(c, http.StatusServiceUnavailable, "org role lookup failed")
+            return
+        }
+        if !ok {
+            httperr.Abort(c, http.StatusForbidden, "missing org role: requires " + want + " in organization " + orgID)
+            return
+        }
+        c.Next()
+    }
+}
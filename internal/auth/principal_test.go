@@ -0,0 +1,35 @@
+package auth
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/gin-gonic/gin"
+)
+
+func TestRequireClientsOnlyTrustsPrimaryIssuer(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    // Any issuer can put client_id and gty into its tokens.
+    claims := Claims{"sub": "booking", "client_id": "booking", "gty": "client-credentials"}
+    cases := map[string]struct {
+        issuer string
+        want   int
+    }{
+        "primary":   {"", http.StatusOK},
+        "secondary": {"https://securetoken.google.com/legacy", http.StatusForbidden},
+    }
+    for name, tc := range cases {
+        r := gin.New()
+        r.GET("/internal", func(c *gin.Context) {
+            c.Set(ContextPrincipalKey, principalFor(claims, tc.issuer))
+        }, RequireClients("booking"), func(c *gin.Context) {
+            c.Status(http.StatusOK)
+        })
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/internal", nil))
+        if w.Code != tc.want {
+            t.Errorf("%s issuer: status %d, want %d", name, w.Code, tc.want)
+        }
+    }
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+
+    "smart-transit-system/internal/audit"
+    "smart-transit-system/internal/httperr"
+    "smart-transit-system/internal/models"
+)
+
+const ContextUserIDKey = "authUserID"
+
+// UserIDFromContext retrieves the local users.id set by Provision.
+func UserIDFromContext(c *gin.Context) (string, bool) {
+    v, ok := c.Get(ContextUserIDKey)
+    if !ok {
+        return "", false
+    }
+    id, ok := v.(string)
+    return id, ok && id != ""
+}
+
+// provisionCache remembers which subjects were already synced so steady-state
+// requests skip the database. Entries expire so profile changes made by the
+// IdP are picked up within the TTL.
+type provisionCache struct {
+    mu      sync.Mutex
+    entries map[string]provisionEntry
+    ttl     time.Duration
+    max     int
+}
+
+type provisionEntry struct {
+    userID      string
+    fingerprint string
+    expires     time.Time
+}
+
+func (pc *provisionCache) get(key, fp string) (string, bool) {
+    pc.mu.Lock()
+    defer pc.mu.Unlock()
+    e, ok := pc.entries[key]
+    if !ok || e.fingerprint != fp || time.Now().After(e.expires) {
+        return "", false
+    }
+    return e.userID, true
+}
+
+func (pc *provisionCache) put(key, fp, userID string) {
+    pc.mu.Lock()
+    defer pc.mu.Unlock()
+    if len(pc.entries) >= pc.max {
+        pc.entries = make(map[string]provisionEntry, pc.max)
+    }
+    pc.entries[key] = provisionEntry{userID: userID, fingerprint: fp, expires: time.Now().Add(pc.ttl)}
+}
+
+// Provision returns middleware (to run after Middleware) that upserts the
+// caller into the users table keyed by (issuer, sub), syncs email/name/phone from
+// claims when they change, and stores the local user id in the context.
+// Service principals are passed through untouched.
+func Provision(db *gorm.DB) gin.HandlerFunc {
+    cache := &provisionCache{entries: make(map[string]provisionEntry), ttl: 5 * time.Minute, max: 10000}
+    return func(c *gin.Context) {
+        claims, ok := FromContext(c)
+        if !ok {
+            httperr.Abort(c, http.StatusUnauthorized, "no auth context")
+            return
+        }
+        // Services calling with client-credentials tokens have no user row.
+        p, ok := PrincipalFromContext(c)
+        if ok && p.IsService() {
+            c.Next()
+            return
+        }
+        issuer := ""
+        if ok {
+            issuer = p.Issuer
+        }
+        sub := claims.Subject()
+        if sub == "" {
+            httperr.Abort(c, http.StatusUnauthorized, "token has no subject")
+            return
+        }
+        key := SubjectKey(issuer, sub)
+        fp := claimsFingerprint(claims)
+        if id, ok := cache.get(key, fp); ok {
+            c.Set(ContextUserIDKey, id)
+            c.Next()
+            return
+        }
+
+        user, err := provisionUser(db.WithContext(c.Request.Context()), issuer, claims)
+        if err != nil {
+            log.Printf("WARN: provisioning %s failed: %v", key, err)
+            httperr.Abort(c, http.StatusServiceUnavailable, "user provisioning failed")
+            return
+        }
+        cache.put(key, fp, user.ID)
+        c.Set(ContextUserIDKey, user.ID)
+        c.Next()
+    }
+}
+
+// claimsFingerprint hashes the profile claims we sync into the users table.
+func claimsFingerprint(claims Claims) string {
+    b, _ := json.Marshal(profileClaims(claims))
+    sum := sha256.Sum256(b)
+    return hex.EncodeToString(sum[:])
+}
+
+// profileClaims extracts the claims mirrored into users columns. The email
+// is only taken when the issuer verified it: users.email is trusted to link
+// accounts (e.g. by the SCIM outbox), so an unverified address never lands
+// there.
+func profileClaims(claims Claims) map[string]string {
+    email := ""
+    if claims.EmailVerified() {
+        email = claims.Email()
+    }
+    return map[string]string{
+        "email":      email,
+        "first_name": claims.GivenName(),
+        "last_name":  claims.FamilyName(),
+        "phone":      claims.PhoneNumber(),
+    }
+}
+
+// provisionUser inserts issuer's user on first sight. Afterwards a field is only
+// synced when the IdP's claim changed since the last sync, so local edits are
+// not overwritten by an unchanged token value.
+func provisionUser(db *gorm.DB, issuer string, claims Claims) (*models.User, error) {
+    sub := claims.Subject()
+    seen := profileClaims(claims)
+    seenJSON, _ := json.Marshal(seen)
+    fresh := models.User{
+        Issuer:       issuer,
+        Sub:          sub,
+        Email:        seen["email"],
+        FirstName:    seen["first_name"],
+        LastName:     seen["last_name"],
+        Phone:        seen["phone"],
+        SyncedClaims: string(seenJSON),
+    }
+    res := db.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "issuer"}, {Name: "sub"}}, DoNothing: true}).Create(&fresh)
+    if res.Error != nil {
+        return nil, res.Error
+    }
+    if res.RowsAffected == 1 {
+        details := map[string]any{"sub": sub}
+        if issuer != "" {
+            details["issuer"] = issuer
+        }
+        audit.Write(db, fresh.ID, "", "provisioned", details)
+        return &fresh, nil
+    }
+
+    var user models.User
+    if err := db.Where("issuer = ? AND sub = ?", issuer, sub).First(&user).Error; err != nil {
+        return nil, err
+    }
+    if user.SyncedClaims == string(seenJSON) {
+        return &user, nil
+    }
+    last := map[string]string{}
+    _ = json.Unmarshal([]byte(user.SyncedClaims), &last)
+    current := map[string]string{
+        "email":      user.Email,
+        "first_name": user.FirstName,
+        "last_name":  user.LastName,
+        "phone":      user.Phone,
+    }
+    changes := map[string]any{"synced_claims": string(seenJSON)}
+    diff := map[string]any{}
+    for col, claim := range seen {
+        if claim == "" || claim == last[col] || claim == current[col] {
+            continue
+        }
+        changes[col] = claim
+        diff[col] = map[string]string{"from": current[col], "to": claim}
+    }
+    if err := db.Model(&user).Updates(changes).Error; err != nil {
+        return nil, err
+    }
+    if len(diff) > 0 {
+        audit.Write(db, user.ID, "", "claims_synced", diff)
+    }
+    return &user, nil
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+
+    "smart-transit-system/internal/models"
+)
+
+var (
+    ErrTokenRevoked = errors.New("token has been revoked")
+    ErrUserDisabled = errors.New("user account is not active")
+)
+
+// Revocations is the local denylist: revoked token ids (jti), users whose
+// tokens issued before a point in time are rejected (sub), revoked IdP
+// sessions (sid), and users whose status is not active. Users are keyed by
+// SubjectKey, so a sub only matches tokens of the issuer it belongs to. The tables are
+// mirrored in memory and re-read periodically, so checks cost no database
+// round trip; other replicas pick up changes within the refresh interval.
+type Revocations struct {
+    db        *gorm.DB
+    retention time.Duration // how long sub/sid entries are kept; must exceed the token lifetime
+
+    mu       sync.RWMutex
+    jtis     map[string]bool
+    subs     map[string]time.Time // SubjectKey -> revoked before
+    sids     map[string]bool      // SubjectKey(issuer, sid)
+    disabled map[string]string // SubjectKey -> status
+}
+
+// NewRevocations loads the denylist from the database.
+func NewRevocations(db *gorm.DB, retention time.Duration) (*Revocations, error) {
+    if retention <= 0 {
+        retention = 24 * time.Hour
+    }
+    r := &Revocations{db: db, retention: retention}
+    if err := r.Reload(context.Background()); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+// UseRevocations enables denylist checks in Middleware.
+func (a *Auth) UseRevocations(r *Revocations) { a.revocations = r }
+
+// Reload re-reads revocations and disabled users and purges expired rows.
+func (r *Revocations) Reload(ctx context.Context) error {
+    db := r.db.WithContext(ctx)
+    if err := db.Where("expires_at < ?", time.Now()).Delete(&models.TokenRevocation{}).Error; err != nil {
+        return fmt.Errorf("purge revocations: %w", err)
+    }
+    var rows []models.TokenRevocation
+    if err := db.Find(&rows).Error; err != nil {
+        return fmt.Errorf("load revocations: %w", err)
+    }
+    var users []models.User
+    if err := db.Select("issuer", "sub", "status").Where("status <> ?", models.UserStatusActive).Find(&users).Error; err != nil {
+        return fmt.Errorf("load disabled users: %w", err)
+    }
+
+    jtis, subs, sids := map[string]bool{}, map[string]time.Time{}, map[string]bool{}
+    for _, row := range rows {
+        switch row.Kind {
+        case models.RevokeJTI:
+            jtis[row.Value] = true
+        case models.RevokeSubject:
+            subs[row.Value] = row.RevokedBefore
+        case models.RevokeSID:
+            sids[row.Value] = true
+        }
+    }
+    disabled := make(map[string]string, len(users))
+    for _, u := range users {
+        disabled[SubjectKey(u.Issuer, u.Sub)] = u.Status
+    }
+
+    r.mu.Lock()
+    r.jtis, r.subs, r.sids, r.disabled = jtis, subs, sids, disabled
+    r.mu.Unlock()
+    return nil
+}
+
+// Watch reloads the denylist every interval until ctx ends.
+func (r *Revocations) Watch(ctx context.Context, interval time.Duration) {
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+            if err := r.Reload(ctx); err != nil {
+                log.Printf("WARN: revocation reload failed, keeping previous list: %v", err)
+            }
+        }
+    }
+}
+
+// check rejects revoked tokens and disabled users. issuer namespaces the
+// token's sub (see UserIssuer).
+func (r *Revocations) check(claims Claims, issuer string) error {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    sub := SubjectKey(issuer, claims.Subject())
+    if status, ok := r.disabled[sub]; ok {
+        return tokenError(ReasonUserDisabled, ErrUserDisabled, fmt.Errorf("user %s is %s", sub, status))
+    }
+    if jti, _ := claims["jti"].(string); jti != "" && r.jtis[jti] {
+        return tokenError(ReasonRevoked, ErrTokenRevoked, fmt.Errorf("jti %s revoked", jti))
+    }
+    if sid := claims.SID(); sid != "" && r.sids[SubjectKey(issuer, sid)] {
+        return tokenError(ReasonRevoked, ErrTokenRevoked, fmt.Errorf("sid %s revoked", sid))
+    }
+    if before, ok := r.subs[sub]; ok {
+        iat, hasIat := claims.IssuedAt()
+        if !hasIat || iat.Before(before) {
+            return tokenError(ReasonRevoked, ErrTokenRevoked, fmt.Errorf("tokens of %s issued before %s revoked", sub, before.UTC().Format(time.RFC3339)))
+        }
+    }
+    return nil
+}
+
+// RevokeJTI revokes a single token until expires (the token's exp; zero
+// keeps the entry for the retention period).
+func (r *Revocations) RevokeJTI(ctx context.Context, jti string, expires time.Time, actorID, reason string) error {
+    if expires.IsZero() {
+        expires = time.Now().Add(r.retention)
+    }
+    if err := r.save(ctx, models.TokenRevocation{Kind: models.RevokeJTI, Value: jti, ExpiresAt: expires, Reason: reason, ActorID: actorID}); err != nil {
+        return err
+    }
+    r.mu.Lock()
+    r.jtis[jti] = true
+    r.mu.Unlock()
+    return nil
+}
+
+// RevokeSubject rejects every token of issuer's sub issued before before
+// and ends the user's BFF sessions.
+func (r *Revocations) RevokeSubject(ctx context.Context, issuer, sub string, before time.Time, actorID, reason string) error {
+    if before.IsZero() {
+        before = time.Now()
+    }
+    key := SubjectKey(issuer, sub)
+    row := models.TokenRevocation{Kind: models.RevokeSubject, Value: key, RevokedBefore: before, ExpiresAt: before.Add(r.retention), Reason: reason, ActorID: actorID}
+    if err := r.save(ctx, row); err != nil {
+        return err
+    }
+    // BFF sessions only come from logins at the primary issuer
+    if issuer == "" {
+        if err := r.db.WithContext(ctx).Where("sub = ?", sub).Delete(&models.Session{}).Error; err != nil {
+            return fmt.Errorf("delete sessions: %w", err)
+        }
+    }
+    r.mu.Lock()
+    r.subs[key] = before
+    r.mu.Unlock()
+    return nil
+}
+
+// RevokeSID rejects every token carrying issuer's IdP session id sid and
+// ends the BFF sessions created from it. Session ids are only unique per
+// issuer, so they are keyed like subjects.
+func (r *Revocations) RevokeSID(ctx context.Context, issuer, sid, actorID, reason string) error {
+    key := SubjectKey(issuer, sid)
+    row := models.TokenRevocation{Kind: models.RevokeSID, Value: key, ExpiresAt: time.Now().Add(r.retention), Reason: reason, ActorID: actorID}
+    if err := r.save(ctx, row); err != nil {
+        return err
+    }
+    if issuer == "" {
+        if err := r.db.WithContext(ctx).Where("s_id = ?", sid).Delete(&models.Session{}).Error; err != nil {
+            return fmt.Errorf("delete sessions: %w", err)
+        }
+    }
+    r.mu.Lock()
+    r.sids[key] = true
+    r.mu.Unlock()
+    return nil
+}
+
+// SetUserStatus updates the in-memory view after a user's status changed
+// locally, so this replica enforces it immediately.
+func (r *Revocations) SetUserStatus(issuer, sub, status string) {
+    key := SubjectKey(issuer, sub)
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if status == models.UserStatusActive {
+        delete(r.disabled, key)
+    } else {
+        r.disabled[key] = status
+    }
+}
+
+// save upserts a revocation; re-revoking moves the cut-off and expiry.
+func (r *Revocations) save(ctx context.Context, row models.TokenRevocation) error {
+    q := r.db.WithContext(ctx).Clauses(clause.OnConflict{
+        Columns:   []clause.Column{{Name: "kind"}, {Name: "value"}},
+        DoUpdates: clause.AssignmentColumns([]string{"revoked_before", "expires_at", "reason"}),
+    })
+    if row.ActorID == "" {
+        q = q.Omit("ActorID")
+    }
+    if err := q.Create(&row).Error; err != nil {
+        return fmt.Errorf("save revocation: %w", err)
+    }
+    return nil
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+    "sync"
+
+    "github.com/gin-gonic/gin"
+
+    "smart-transit-system/internal/httperr"
+)
+
+// Transit roles, matching the user_role enum of the main schema.
+const (
+    RolePassenger   = "passenger"
+    RoleDriver      = "driver"
+    RoleConductor   = "conductor"
+    RoleBusOwner    = "bus_owner"
+    RoleLoungeOwner = "lounge_owner"
+    RoleAdmin       = "admin"
+)
+
+var transitRoles = map[string]bool{
+    RolePassenger:   true,
+    RoleDriver:      true,
+    RoleConductor:   true,
+    RoleBusOwner:    true,
+    RoleLoungeOwner: true,
+    RoleAdmin:       true,
+}
+
+// RoleMapping maps IdP role/group names to transit roles. Names are compared
+// after normalization (Internal/ and Application/ prefixes removed,
+// lowercased, spaces and dashes turned into underscores); a normalized name
+// that already is a transit role maps to itself.
+type RoleMapping struct {
+    groups map[string]string
+}
+
+// ParseRoleMapping parses "Group Name=role,Other=role" into a mapping. An
+// empty spec yields the default mapping.
+func ParseRoleMapping(spec string) (*RoleMapping, error) {
+    m := &RoleMapping{groups: map[string]string{
+        "company_owner": RoleBusOwner, // name used in the Asgardeo setup guide
+        "administrator": RoleAdmin,
+    }}
+    for _, pair := range strings.Split(spec, ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        group, role, ok := strings.Cut(pair, "=")
+        role = strings.TrimSpace(role)
+        if !ok || strings.TrimSpace(group) == "" {
+            return nil, fmt.Errorf("role mapping %q: want group=role", pair)
+        }
+        if !transitRoles[role] {
+            return nil, fmt.Errorf("role mapping %q: unknown role %q", pair, role)
+        }
+        m.groups[normalizeRoleName(group)] = role
+    }
+    return m, nil
+}
+
+// Map converts raw role/group names into de-duplicated transit roles;
+// names without a mapping are dropped.
+func (m *RoleMapping) Map(raw []string) []string {
+    seen := make(map[string]bool, len(raw))
+    out := make([]string, 0, len(raw))
+    for _, r := range raw {
+        n := normalizeRoleName(r)
+        role, ok := m.groups[n]
+        if !ok && transitRoles[n] {
+            role, ok = n, true
+        }
+        if ok && !seen[role] {
+            seen[role] = true
+            out = append(out, role)
+        }
+    }
+    return out
+}
+
+func normalizeRoleName(s string) string {
+    s = strings.TrimSpace(s)
+    for _, p := range []string{"internal/", "application/"} {
+        if len(s) >= len(p) && strings.EqualFold(s[:len(p)], p) {
+            s = s[len(p):]
+        }
+    }
+    s = strings.ToLower(strings.TrimSpace(s))
+    s = strings.NewReplacer(" ", "_", "-", "_").Replace(s)
+    return s
+}
+
+var (
+    roleMappingMu sync.RWMutex
+    roleMapping   = func() *RoleMapping { m, _ := ParseRoleMapping(""); return m }()
+)
+
+// SetRoleMapping replaces the mapping used by TransitRoles and the role
+// middlewares. Call it once at startup.
+func SetRoleMapping(m *RoleMapping) {
+    roleMappingMu.Lock()
+    defer roleMappingMu.Unlock()
+    roleMapping = m
+}
+
+// TransitRoles returns the caller's roles and groups mapped onto the
+// transit roles. Asgardeo tokens usually carry both claims, so both are read.
+func (c Claims) TransitRoles() []string {
+    roleMappingMu.RLock()
+    m := roleMapping
+    roleMappingMu.RUnlock()
+    return m.Map(append(c.Roles(), c.Groups()...))
+}
+
+// RequireRoles ensures the token maps to all required transit roles.
+func RequireRoles(required ...string) gin.HandlerFunc {
+    return requireRoles(required, true)
+}
+
+// RequireAnyRole ensures the token maps to at least one of the given roles.
+func RequireAnyRole(roles ...string) gin.HandlerFunc {
+    return requireRoles(roles, false)
+}
+
+func requireRoles(roles []string, all bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        claims, ok := FromContext(c)
+        if !ok {
+            httperr.Abort(c, http.StatusUnauthorized, "no auth context")
+            return
+        }
+        got := make(map[string]struct{})
+        for _, r := range claims.TransitRoles() {
+            got[r] = struct{}{}
+        }
+        for _, r := range roles {
+            _, has := got[r]
+            if all && !has {
+                httperr.Abort(c, http.StatusForbidden, "missing role: " + r)
+                return
+            }
+            if !all && has {
+                c.Next()
+                return
+            }
+        }
+        if !all && len(roles) > 0 {
+            httperr.Abort(c, http.StatusForbidden, "missing role: one of " + strings.Join(roles, ", "))
+            return
+        }
+        c.Next()
+    }
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+    "context"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "golang.org/x/sync/singleflight"
+    "gorm.io/gorm"
+
+    "smart-transit-system/internal/models"
+)
+
+// CSRFHeader is the request header that must echo the session's CSRF token
+// on unsafe methods when authenticating by session cookie.
+const CSRFHeader = "X-CSRF-Token"
+
+// SessionConfig configures BFF session cookies.
+type SessionConfig struct {
+    CookieName     string        // defaults to "sts_session"
+    CSRFCookieName string        // readable by JS; defaults to "sts_csrf"
+    TTL            time.Duration // defaults to 8h
+    Secure         bool          // set Secure on cookies (HTTPS only)
+    SameSite       http.SameSite // defaults to Lax
+}
+
+// Sessions stores tokens server-side and authenticates browsers by cookie
+// (backend-for-frontend mode).
+type Sessions struct {
+    db       *gorm.DB
+    flow     *Flow
+    cfg      SessionConfig
+    refresh  singleflight.Group
+    skew     time.Duration // refresh access tokens this close to expiry
+}
+
+var (
+    ErrNoSession = errors.New("session not found or expired")
+    ErrCSRF      = errors.New("missing or invalid CSRF token")
+)
+
+// NewSessions builds a session store backed by the sessions table.
+func NewSessions(db *gorm.DB, flow *Flow, cfg SessionConfig) (*Sessions, error) {
+    if db == nil || flow == nil {
+        return nil, errors.New("database and login flow are required")
+    }
+    if cfg.CookieName == "" {
+        cfg.CookieName = "sts_session"
+    }
+    if cfg.CSRFCookieName == "" {
+        cfg.CSRFCookieName = "sts_csrf"
+    }
+    if cfg.TTL <= 0 {
+        cfg.TTL = 8 * time.Hour
+    }
+    if cfg.SameSite == 0 {
+        cfg.SameSite = http.SameSiteLaxMode
+    }
+    return &Sessions{db: db, flow: flow, cfg: cfg, skew: 30 * time.Second}, nil
+}
+
+// Create persists a session for a completed login and sets the cookies.
+func (s *Sessions) Create(c *gin.Context, ts *TokenSet) (*models.Session, error) {
+    raw, err := randomString(32)
+    if err != nil {
+        return nil, err
+    }
+    csrf, err := randomString(24)
+    if err != nil {
+        return nil, err
+    }
+    sid, _ := ts.IDClaims["sid"].(string)
+    sess := &models.Session{
+        ID:           hashSessionID(raw),
+        Sub:          ts.IDClaims.Subject(),
+        SID:          sid,
+        AccessToken:  ts.AccessToken,
+        RefreshToken: ts.RefreshToken,
+        IDToken:      ts.IDToken,
+        TokenExpiry:  tokenExpiry(ts),
+        CSRFToken:    csrf,
+        ExpiresAt:    time.Now().Add(s.cfg.TTL),
+    }
+    if err := s.db.WithContext(c.Request.Context()).Create(sess).Error; err != nil {
+        return nil, fmt.Errorf("create session: %w", err)
+    }
+    s.setCookies(c, raw, csrf, int(s.cfg.TTL.Seconds()))
+    return sess, nil
+}
+
+// Destroy deletes the caller's session (if any) and clears the cookies.
+// Whatever the method, a request carrying the session cookie must echo the
+// session's CSRF token: a cross-site top-level GET sends the Lax cookie too.
+// Otherwise ErrCSRF is returned and the session is kept.
+func (s *Sessions) Destroy(c *gin.Context) (*models.Session, error) {
+    var sess *models.Session
+    if raw, err := c.Cookie(s.cfg.CookieName); err == nil && raw != "" {
+        got := c.GetHeader(CSRFHeader)
+        if got == "" {
+            return nil, ErrCSRF
+        }
+        var row models.Session
+        id := hashSessionID(raw)
+        if err := s.db.WithContext(c.Request.Context()).First(&row, "id = ?", id).Error; err == nil {
+            if subtle.ConstantTimeCompare([]byte(got), []byte(row.CSRFToken)) != 1 {
+                return nil, ErrCSRF
+            }
+            sess = &row
+        }
+        if err := s.db.WithContext(c.Request.Context()).Delete(&models.Session{}, "id = ?", id).Error; err != nil {
+            return sess, fmt.Errorf("delete session: %w", err)
+        }
+    }
+    s.setCookies(c, "", "", -1)
+    return sess, nil
+}
+
+// HasCookie reports whether the request carries a session cookie.
+func (s *Sessions) HasCookie(c *gin.Context) bool {
+    v, err := c.Cookie(s.cfg.CookieName)
+    return err == nil && v != ""
+}
+
+// AccessToken resolves the session cookie to a current access token,
+// refreshing it with the stored refresh token when it is about to expire.
+// Unsafe methods must carry a matching CSRF header.
+func (s *Sessions) AccessToken(c *gin.Context) (string, error) {
+    raw, err := c.Cookie(s.cfg.CookieName)
+    if err != nil || raw == "" {
+        return "", ErrNoSession
+    }
+    ctx := c.Request.Context()
+    id := hashSessionID(raw)
+    var sess models.Session
+    if err := s.db.WithContext(ctx).First(&sess, "id = ? AND expires_at > ?", id, time.Now()).Error; err != nil {
+        return "", ErrNoSession
+    }
+    if !safeMethod(c.Request.Method) {
+        got := c.GetHeader(CSRFHeader)
+        if got == "" || subtle.ConstantTimeCompare([]byte(got), []byte(sess.CSRFToken)) != 1 {
+            return "", ErrCSRF
+        }
+    }
+    if time.Until(sess.TokenExpiry) > s.skew {
+        return sess.AccessToken, nil
+    }
+    if sess.RefreshToken == "" {
+        return "", ErrNoSession
+    }
+    // Deduplicate concurrent refreshes for the same session so a rotating
+    // refresh token is only spent once.
+    v, err, _ := s.refresh.Do(id, func() (any, error) {
+        return s.refreshSession(ctx, id)
+    })
+    if err != nil {
+        return "", err
+    }
+    return v.(string), nil
+}
+
+func (s *Sessions) refreshSession(ctx context.Context, id string) (string, error) {
+    var sess models.Session
+    if err := s.db.WithContext(ctx).First(&sess, "id = ?", id).Error; err != nil {
+        return "", ErrNoSession
+    }
+    // Another replica may have refreshed already.
+    if time.Until(sess.TokenExpiry) > s.skew {
+        return sess.AccessToken, nil
+    }
+    ts, err := s.flow.Refresh(ctx, sess.RefreshToken)
+    if err != nil {
+        return "", fmt.Errorf("refresh session: %w", err)
+    }
+    updates := map[string]any{
+        "access_token": ts.AccessToken,
+        "token_expiry": tokenExpiry(ts),
+    }
+    if ts.RefreshToken != "" {
+        updates["refresh_token"] = ts.RefreshToken
+    }
+    if ts.IDToken != "" {
+        updates["id_token"] = ts.IDToken
+    }
+    if err := s.db.WithContext(ctx).Model(&models.Session{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+        return "", fmt.Errorf("save session: %w", err)
+    }
+    return ts.AccessToken, nil
+}
+
+func (s *Sessions) setCookies(c *gin.Context, raw, csrf string, maxAge int) {
+    c.SetSameSite(s.cfg.SameSite)
+    c.SetCookie(s.cfg.CookieName, raw, maxAge, "/", "", s.cfg.Secure, true)
+    // The CSRF cookie is readable so the SPA can echo it in CSRFHeader.
+    c.SetCookie(s.cfg.CSRFCookieName, csrf, maxAge, "/", "", s.cfg.Secure, false)
+}
+
+func hashSessionID(raw string) string {
+    sum := sha256.Sum256([]byte(raw))
+    return hex.EncodeToString(sum[:])
+}
+
+func tokenExpiry(ts *TokenSet) time.Time {
+    if ts.ExpiresIn > 0 {
+        return time.Now().Add(time.Duration(ts.ExpiresIn) * time.Second)
+    }
+    return time.Now().Add(5 * time.Minute)
+}
+
+func safeMethod(m string) bool {
+    switch m {
+    case http.MethodGet, http.MethodHead, http.MethodOptions:
+        return true
+    }
+    return false
+}
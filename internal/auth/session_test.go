@@ -0,0 +1,29 @@
+package auth
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/gin-gonic/gin"
+)
+
+func TestDestroyRequiresCSRFHeaderOnGET(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    s := &Sessions{cfg: SessionConfig{CookieName: "sts_session", CSRFCookieName: "sts_csrf"}}
+
+    // A cross-site navigation carries the Lax cookie but cannot set headers.
+    w := httptest.NewRecorder()
+    c, _ := gin.CreateTestContext(w)
+    c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/auth/logout", nil)
+    c.Request.AddCookie(&http.Cookie{Name: "sts_session", Value: "victim-session"})
+
+    sess, err := s.Destroy(c)
+    if !errors.Is(err, ErrCSRF) || sess != nil {
+        t.Fatalf("Destroy = %v, %v; want ErrCSRF", sess, err)
+    }
+    if cookies := w.Result().Cookies(); len(cookies) != 0 {
+        t.Errorf("session cookies were cleared: %v", cookies)
+    }
+}
@@ -12,7 +12,78 @@ type Config struct {
     // Auth / Asgardeo
     AsgardeoIssuer   string // e.g., https://<org>.asgard.<region>.asgardeo.io/t/<tenant>/oauth2/token (issuer base)
     AsgardeoAudience string // optional expected audience; leave empty to skip aud check
+    TrustedIssuers   string // optional JSON array of additional issuers (see auth.IssuerConfig)
+    IssuerAllowlist  string // extra exact iss values accepted for ASGARDEO_ISSUER (comma-separated)
+    IssuerAliases    string // "alias=>canonical" rules (comma-separated)
+    IssuerStrict     string // "true" to require an exact iss match
     JWKSCacheMinutes string // optional, minutes to cache JWKS before refresh
+    // Token time checks
+    TokenLeewaySeconds     string // clock skew tolerated on exp/nbf/iat
+    TokenMaxAgeSeconds     string // optional max age from iat for all protected routes; empty disables
+    SensitiveMaxAuthAgeSec string // optional max age of auth_time on sensitive routes (org/user admin)
+    // Step-up authentication for admin actions; all empty disables it
+    StepUpACR           string // acceptable acr values (comma-separated)
+    StepUpAMR           string // acceptable amr methods, e.g. "otp,mfa"
+    StepUpMaxAgeSeconds string // login must be this recent
+    // Server-side login (authorization code + PKCE)
+    AsgardeoClientID     string
+    AsgardeoClientSecret string // optional; confidential clients only
+    AuthCallbackURL      string // e.g., http://localhost:8080/api/v1/auth/callback
+    AuthStateSecret      string // optional HMAC key for state; random per process if empty
+    // Backend-for-frontend session mode
+    BFFEnabled        string // "true" to keep tokens server-side behind a session cookie
+    SessionCookieName string
+    SessionTTLHours   string
+    CookieSecure      string // "false" only for local HTTP development
+    PostLoginRedirect string // where the browser lands after a BFF login
+    // RP-initiated logout
+    PostLogoutRedirect     string // default post_logout_redirect_uri
+    PostLogoutRedirectURIs string // other allowed post_logout_redirect_uri values (comma-separated, exact)
+    // Client ids of internal services (booking, tracking, payments) allowed on /internal
+    InternalClientIDs string
+    // Maps IdP group/role names to transit roles, e.g. "Bus Owners=bus_owner,Staff=conductor"
+    RoleGroupMapping string
+    // Declarative route authorization
+    PolicyFile          string // path to a JSON or YAML (.yaml/.yml) policy file; empty disables the policy engine
+    PolicyMode          string // optional override: enforce|audit
+    PolicyReloadSeconds string // how often to check the file for changes
+    // RFC 7662 introspection for opaque access tokens
+    IntrospectionMode         string // off|opaque|always
+    IntrospectionClientID     string // defaults to ASGARDEO_CLIENT_ID
+    IntrospectionClientSecret string // defaults to ASGARDEO_CLIENT_SECRET
+    IntrospectionCacheSize    string
+    // RFC 9449 DPoP sender-constrained tokens
+    DPoPEnabled       string // "true" to accept Authorization: DPoP
+    DPoPPublicBaseURL string // external scheme://host used to check htu; required with DPoPEnabled
+    DPoPReplayStore   string // memory|postgres
+    // TLS termination, optionally with client certificates (RFC 8705)
+    TLSCertFile     string
+    TLSKeyFile      string
+    TLSClientCAFile string // CA bundle for client certificates; empty disables mTLS
+    TLSClientAuth   string // optional|require
+    // Local token revocation / user lockout
+    RevocationRefreshSeconds string // how often other replicas' revocations are picked up
+    RevocationRetentionHours string // how long user/session revocations are kept (> token lifetime)
+    BackchannelAllSessions   string // "true": a back-channel logout naming a sid also revokes all of the user's tokens
+    // Client-credentials identity this service uses for outbound calls
+    ServiceClientID      string
+    ServiceClientSecret  string // client_secret_basic; or set ServiceClientKeyFile
+    ServiceClientKeyFile string // PEM private key for private_key_jwt
+    ServiceClientKeyID   string // kid of the registered public key
+    ServiceClientScopes  string // space-separated scopes to request
+    // SCIM push of local user/membership changes to the IdP
+    SCIMBaseURL         string // e.g. https://api.asgardeo.io/t/<org>/scim2; empty disables
+    SCIMGroupPrefix     string // org role groups are <prefix>_<org id>_<role>
+    SCIMIntervalSeconds string // how often the outbox is drained
+    SCIMMaxAttempts     string // attempts before a change is parked
+    // Inbound SCIM server for enterprise customers provisioning their staff
+    SCIMTenants     string // "client-id=org-id@issuer,..."; empty disables /scim/v2
+    SCIMScope       string // scope required on SCIM requests
+    SCIMDefaultRole string // org role of provisioned users outside any group
+    SCIMPublicBaseURL string // external scheme://host for resource locations; defaults to DPOP_PUBLIC_BASE_URL
+    // Periodic reconciliation of local users against the IdP's user list (needs SCIMBaseURL)
+    ReconcileIntervalMinutes string // 0 disables
+    ReconcilePageSize        string // users fetched per SCIM list request
 }
 
 func Load() *Config {
@@ -25,7 +96,62 @@ func Load() *Config {
         Port:       getEnv("PORT", "8080"),
         AsgardeoIssuer:   getEnv("ASGARDEO_ISSUER", ""),
         AsgardeoAudience: getEnv("ASGARDEO_AUDIENCE", ""),
+        TrustedIssuers:   getEnv("TRUSTED_ISSUERS", ""),
+        IssuerAllowlist:  getEnv("ISSUER_ALLOWLIST", ""),
+        IssuerAliases:    getEnv("ISSUER_ALIASES", ""),
+        IssuerStrict:     getEnv("ISSUER_STRICT", "false"),
         JWKSCacheMinutes: getEnv("JWKS_CACHE_MINUTES", "60"),
+        TokenLeewaySeconds:     getEnv("TOKEN_LEEWAY_SECONDS", "60"),
+        TokenMaxAgeSeconds:     getEnv("TOKEN_MAX_AGE_SECONDS", ""),
+        SensitiveMaxAuthAgeSec: getEnv("SENSITIVE_MAX_AUTH_AGE_SECONDS", ""),
+        StepUpACR:           getEnv("STEP_UP_ACR_VALUES", ""),
+        StepUpAMR:           getEnv("STEP_UP_AMR", ""),
+        StepUpMaxAgeSeconds: getEnv("STEP_UP_MAX_AGE_SECONDS", ""),
+        AsgardeoClientID:     getEnv("ASGARDEO_CLIENT_ID", ""),
+        AsgardeoClientSecret: getEnv("ASGARDEO_CLIENT_SECRET", ""),
+        AuthCallbackURL:      getEnv("AUTH_CALLBACK_URL", ""),
+        AuthStateSecret:      getEnv("AUTH_STATE_SECRET", ""),
+        BFFEnabled:        getEnv("AUTH_BFF_ENABLED", "false"),
+        SessionCookieName: getEnv("SESSION_COOKIE_NAME", "sts_session"),
+        SessionTTLHours:   getEnv("SESSION_TTL_HOURS", "8"),
+        CookieSecure:      getEnv("COOKIE_SECURE", "true"),
+        PostLoginRedirect: getEnv("AUTH_POST_LOGIN_REDIRECT", ""),
+        PostLogoutRedirect:     getEnv("AUTH_POST_LOGOUT_REDIRECT", ""),
+        PostLogoutRedirectURIs: getEnv("AUTH_POST_LOGOUT_REDIRECT_URIS", ""),
+        RoleGroupMapping:  getEnv("ROLE_GROUP_MAPPING", ""),
+        InternalClientIDs: getEnv("INTERNAL_CLIENT_IDS", ""),
+        PolicyFile:          getEnv("POLICY_FILE", ""),
+        PolicyMode:          getEnv("POLICY_MODE", ""),
+        PolicyReloadSeconds: getEnv("POLICY_RELOAD_SECONDS", "10"),
+        IntrospectionMode:         getEnv("TOKEN_INTROSPECTION", "off"),
+        IntrospectionClientID:     getEnv("INTROSPECTION_CLIENT_ID", getEnv("ASGARDEO_CLIENT_ID", "")),
+        IntrospectionClientSecret: getEnv("INTROSPECTION_CLIENT_SECRET", getEnv("ASGARDEO_CLIENT_SECRET", "")),
+        IntrospectionCacheSize:    getEnv("INTROSPECTION_CACHE_SIZE", "10000"),
+        DPoPEnabled:       getEnv("DPOP_ENABLED", "false"),
+        DPoPPublicBaseURL: getEnv("DPOP_PUBLIC_BASE_URL", ""),
+        DPoPReplayStore:   getEnv("DPOP_REPLAY_STORE", "memory"),
+        TLSCertFile:     getEnv("TLS_CERT_FILE", ""),
+        TLSKeyFile:      getEnv("TLS_KEY_FILE", ""),
+        TLSClientCAFile: getEnv("TLS_CLIENT_CA_FILE", ""),
+        TLSClientAuth:   getEnv("TLS_CLIENT_AUTH", "optional"),
+        RevocationRefreshSeconds: getEnv("REVOCATION_REFRESH_SECONDS", "15"),
+        RevocationRetentionHours: getEnv("REVOCATION_RETENTION_HOURS", "24"),
+        BackchannelAllSessions:   getEnv("BACKCHANNEL_LOGOUT_ALL_SESSIONS", "false"),
+        ServiceClientID:      getEnv("SERVICE_CLIENT_ID", ""),
+        ServiceClientSecret:  getEnv("SERVICE_CLIENT_SECRET", ""),
+        ServiceClientKeyFile: getEnv("SERVICE_CLIENT_KEY_FILE", ""),
+        ServiceClientKeyID:   getEnv("SERVICE_CLIENT_KEY_ID", ""),
+        ServiceClientScopes:  getEnv("SERVICE_CLIENT_SCOPES", ""),
+        SCIMBaseURL:         getEnv("SCIM_BASE_URL", ""),
+        SCIMGroupPrefix:     getEnv("SCIM_GROUP_PREFIX", "transit"),
+        SCIMIntervalSeconds: getEnv("SCIM_SYNC_INTERVAL_SECONDS", "10"),
+        SCIMMaxAttempts:     getEnv("SCIM_MAX_ATTEMPTS", "10"),
+        SCIMTenants:     getEnv("SCIM_TENANTS", ""),
+        SCIMScope:       getEnv("SCIM_SCOPE", "scim.provision"),
+        SCIMDefaultRole: getEnv("SCIM_DEFAULT_ROLE", "member"),
+        SCIMPublicBaseURL: getEnv("SCIM_PUBLIC_BASE_URL", getEnv("DPOP_PUBLIC_BASE_URL", "")),
+        ReconcileIntervalMinutes: getEnv("RECONCILE_INTERVAL_MINUTES", "60"),
+        ReconcilePageSize:        getEnv("RECONCILE_PAGE_SIZE", "100"),
     }
 }
 
@@ -1,12 +1,21 @@
 package handlers
 
 import (
+    "errors"
+    "log"
     "net/url"
     "os"
+    "strconv"
     "strings"
     "net/http"
+    "time"
 
     "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "smart-transit-system/internal/audit"
+    "smart-transit-system/internal/auth"
+    "smart-transit-system/internal/httperr"
+    "smart-transit-system/internal/models"
 )
 
 // AuthLogin returns an authorize URL template for SPA PKCE login.
@@ -17,9 +26,7 @@ func AuthLogin(c *gin.Context) {
     redirectURI := os.Getenv("ASGARDEO_REDIRECT_URI")
 
     if baseIssuer == "" || clientID == "" || redirectURI == "" {
-        c.JSON(http.StatusBadRequest, gin.H{
-            "error": "missing ASGARDEO_ISSUER, ASGARDEO_CLIENT_ID, or ASGARDEO_REDIRECT_URI",
-        })
+        httperr.JSON(c, http.StatusBadRequest, "missing ASGARDEO_ISSUER, ASGARDEO_CLIENT_ID, or ASGARDEO_REDIRECT_URI")
         return
     }
 
@@ -58,19 +65,20 @@ func AuthLogin(c *gin.Context) {
 }
 
 // AuthAuthorize redirects to Asgardeo authorize endpoint when provided with PKCE params.
+// Optional acr_values and max_age are passed through for step-up logins.
 func AuthAuthorize(c *gin.Context) {
     baseIssuer := strings.TrimRight(os.Getenv("ASGARDEO_ISSUER"), "/")
     clientID := os.Getenv("ASGARDEO_CLIENT_ID")
     redirectURI := os.Getenv("ASGARDEO_REDIRECT_URI")
     if baseIssuer == "" || clientID == "" || redirectURI == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "missing ASGARDEO_ISSUER/CLIENT_ID/REDIRECT_URI"})
+        httperr.JSON(c, http.StatusBadRequest, "missing ASGARDEO_ISSUER/CLIENT_ID/REDIRECT_URI")
         return
     }
     state := c.Query("state")
     codeChallenge := c.Query("code_challenge")
     method := c.DefaultQuery("code_challenge_method", "S256")
     if state == "" || codeChallenge == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "state and code_challenge are required"})
+        httperr.JSON(c, http.StatusBadRequest, "state and code_challenge are required")
         return
     }
     authEndpoint := baseIssuer + "/authorize"
@@ -82,6 +90,228 @@ func AuthAuthorize(c *gin.Context) {
     q.Set("state", state)
     q.Set("code_challenge", codeChallenge)
     q.Set("code_challenge_method", method)
+    // Step-up: forward acr_values/max_age from an insufficient_user_authentication challenge
+    if acr := c.Query("acr_values"); acr != "" {
+        q.Set("acr_values", acr)
+    }
+    if maxAge := c.Query("max_age"); maxAge != "" {
+        if n, err := strconv.Atoi(maxAge); err != nil || n < 0 {
+            httperr.JSON(c, http.StatusBadRequest, "max_age must be a number of seconds")
+            return
+        }
+        q.Set("max_age", maxAge)
+    }
 
     c.Redirect(http.StatusFound, authEndpoint+"?"+q.Encode())
 }
+
+// AuthStart begins a server-side PKCE login: the service generates the
+// verifier and sealed state, binds them to the browser with a cookie and
+// redirects to the authorize endpoint.
+func AuthStart(flow *auth.Flow) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        authorizeURL, err := flow.Begin(c)
+        if err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "could not start login")
+            return
+        }
+        if c.Query("mode") == "json" {
+            c.JSON(http.StatusOK, gin.H{"authorize_url": authorizeURL})
+            return
+        }
+        c.Redirect(http.StatusFound, authorizeURL)
+    }
+}
+
+// AuthCallback completes a login started by AuthStart: it exchanges the
+// authorization code and returns the validated tokens. In BFF mode
+// (sessions non-nil) the tokens stay server-side and the browser receives
+// a session cookie and is redirected to postLoginURL instead.
+func AuthCallback(flow *auth.Flow, sessions *auth.Sessions, postLoginURL string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if e := c.Query("error"); e != "" {
+            httperr.JSONCode(c, http.StatusBadRequest, e, c.Query("error_description"), nil)
+            return
+        }
+        tokens, err := flow.Complete(c, c.Query("state"), c.Query("code"))
+        if err != nil {
+            switch {
+            case errors.Is(err, auth.ErrInvalidState):
+                httperr.JSON(c, http.StatusBadRequest, "invalid state")
+            case errors.Is(err, auth.ErrIDToken):
+                httperr.JSON(c, http.StatusUnauthorized, err.Error())
+            default:
+                httperr.JSON(c, http.StatusBadGateway, "token exchange failed: "+err.Error())
+            }
+            return
+        }
+        c.Header("Cache-Control", "no-store")
+        if sessions != nil {
+            sess, err := sessions.Create(c, tokens)
+            if err != nil {
+                httperr.JSON(c, http.StatusInternalServerError, "could not create session")
+                return
+            }
+            if postLoginURL != "" {
+                c.Redirect(http.StatusFound, postLoginURL)
+                return
+            }
+            c.JSON(http.StatusOK, gin.H{"sub": sess.Sub, "csrf_token": sess.CSRFToken})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{
+            "access_token":  tokens.AccessToken,
+            "id_token":      tokens.IDToken,
+            "refresh_token": tokens.RefreshToken,
+            "token_type":    tokens.TokenType,
+            "expires_in":    tokens.ExpiresIn,
+            "scope":         tokens.Scope,
+            "sub":           tokens.IDClaims.Subject(),
+        })
+    }
+}
+
+// BackchannelLogout receives OIDC Back-Channel Logout 1.0 requests from the
+// IdP: it validates the logout_token and revokes the IdP session (sid),
+// ending matching BFF sessions as well. As the spec says, every current
+// token of the user (sub) is only revoked when the token names no sid, or
+// always with allSessions (which also catches access tokens without a sid
+// claim, at the cost of logging the user out on every device).
+func BackchannelLogout(a *auth.Auth, clientID string, rev *auth.Revocations, db *gorm.DB, allSessions bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Header("Cache-Control", "no-store")
+        raw := c.PostForm("logout_token")
+        if raw == "" {
+            httperr.JSON(c, http.StatusBadRequest, "missing logout_token")
+            return
+        }
+        ctx := c.Request.Context()
+        claims, err := a.VerifyLogoutToken(ctx, raw, clientID)
+        if err != nil {
+            log.Printf("auth: back-channel logout rejected: %v", err)
+            httperr.JSON(c, http.StatusBadRequest, err.Error())
+            return
+        }
+        sub, sid, issuer := claims.Subject(), claims.SID(), a.UserIssuer(claims)
+        if sid != "" {
+            err = rev.RevokeSID(ctx, issuer, sid, "", "backchannel_logout")
+        }
+        if err == nil && sub != "" && (sid == "" || allSessions) {
+            err = rev.RevokeSubject(ctx, issuer, sub, time.Now(), "", "backchannel_logout")
+        }
+        if err != nil {
+            log.Printf("WARN: back-channel logout for sub=%q sid=%q failed: %v", sub, sid, err)
+            httperr.JSON(c, http.StatusInternalServerError, "logout failed")
+            return
+        }
+        if sub != "" {
+            var user models.User
+            if db.WithContext(ctx).Select("id").Where("issuer = ? AND sub = ?", issuer, sub).First(&user).Error == nil {
+                audit.Write(db.WithContext(ctx), user.ID, "", "backchannel_logout", gin.H{"sid": sid})
+            }
+        }
+        c.Status(http.StatusOK)
+    }
+}
+
+// LogoutConfig configures RP-initiated logout.
+type LogoutConfig struct {
+    ClientID         string
+    DefaultRedirect  string   // post_logout_redirect_uri used when the client sends none
+    AllowedRedirects []string // exact post_logout_redirect_uri values clients may request
+}
+
+// AuthLogout ends the local BFF session (if any) and sends the user agent to
+// the IdP's end_session_endpoint with id_token_hint and a validated
+// post_logout_redirect_uri (OIDC RP-Initiated Logout 1.0). Use ?mode=json to
+// get the logout URL instead of a redirect. db may be nil (no audit).
+func AuthLogout(a *auth.Auth, sessions *auth.Sessions, db *gorm.DB, cfg LogoutConfig) gin.HandlerFunc {
+    allowed := map[string]bool{}
+    for _, u := range append(cfg.AllowedRedirects, cfg.DefaultRedirect) {
+        if u = strings.TrimSpace(u); u != "" {
+            allowed[u] = true
+        }
+    }
+    return func(c *gin.Context) {
+        param := func(k string) string {
+            if v := c.Query(k); v != "" {
+                return v
+            }
+            return c.PostForm(k)
+        }
+        redirect := param("post_logout_redirect_uri")
+        if redirect == "" {
+            redirect = cfg.DefaultRedirect
+        } else if !allowed[redirect] {
+            httperr.JSON(c, http.StatusBadRequest, "post_logout_redirect_uri is not allowed")
+            return
+        }
+
+        hint, sub, sid := param("id_token_hint"), "", ""
+        if hint != "" {
+            claims, err := a.VerifyIDTokenHint(hint, cfg.ClientID)
+            if err != nil {
+                httperr.JSON(c, http.StatusBadRequest, "invalid id_token_hint")
+                return
+            }
+            sub, sid = claims.Subject(), claims.SID()
+        }
+        if sessions != nil {
+            sess, err := sessions.Destroy(c)
+            if errors.Is(err, auth.ErrCSRF) {
+                httperr.JSONCode(c, http.StatusForbidden, "invalid_csrf_token", "invalid csrf token", nil)
+                return
+            }
+            if err != nil {
+                log.Printf("WARN: logout: %v", err)
+            }
+            if sess != nil {
+                sub, sid = sess.Sub, sess.SID
+                if hint == "" {
+                    hint = sess.IDToken
+                }
+            }
+        }
+        if db != nil && sub != "" {
+            ctx := c.Request.Context()
+            var user models.User
+            // ID tokens and sessions come from the primary issuer. Users
+            // without a local row are still audited, by sub.
+            details := gin.H{"sid": sid}
+            if db.WithContext(ctx).Select("id").Where("issuer = '' AND sub = ?", sub).First(&user).Error != nil {
+                user.ID = ""
+                details["sub"] = sub
+            }
+            audit.Write(db.WithContext(ctx), user.ID, user.ID, "logout", details)
+        }
+
+        target := redirect
+        if endpoint := a.EndSessionEndpoint(); endpoint != "" {
+            q := url.Values{}
+            q.Set("client_id", cfg.ClientID)
+            if hint != "" {
+                q.Set("id_token_hint", hint)
+            }
+            if redirect != "" {
+                q.Set("post_logout_redirect_uri", redirect)
+            }
+            if state := param("state"); state != "" {
+                q.Set("state", state)
+            }
+            sep := "?"
+            if strings.Contains(endpoint, "?") {
+                sep = "&"
+            }
+            target = endpoint + sep + q.Encode()
+        }
+        c.Header("Cache-Control", "no-store")
+        switch {
+        case c.Query("mode") == "json":
+            c.JSON(http.StatusOK, gin.H{"logout_url": target})
+        case target != "":
+            c.Redirect(http.StatusFound, target)
+        default:
+            c.Status(http.StatusNoContent)
+        }
+    }
+}
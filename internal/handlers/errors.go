@@ -4,13 +4,20 @@ import (
     "net/http"
 
     "github.com/gin-gonic/gin"
+
+    "smart-transit-system/internal/httperr"
 )
 
 // AuthNotConfigured responds when OIDC is not correctly configured at startup.
 func AuthNotConfigured(c *gin.Context) {
-    c.JSON(http.StatusServiceUnavailable, gin.H{
-        "error": "auth_not_configured",
-        "message": "Asgardeo OIDC is not configured or discovery failed. Ensure ASGARDEO_ISSUER is set and reachable.",
-    })
+    httperr.JSONCode(c, http.StatusServiceUnavailable, "auth_not_configured",
+        "Asgardeo OIDC is not configured or discovery failed. Ensure ASGARDEO_ISSUER is set and reachable.", nil)
 }
 
+
+// PolicyUnavailable blocks protected routes when POLICY_FILE is set but
+// could not be loaded at startup.
+func PolicyUnavailable(c *gin.Context) {
+    httperr.AbortCode(c, http.StatusServiceUnavailable, "policy_unavailable",
+        "The authorization policy could not be loaded. Check POLICY_FILE.", nil)
+}
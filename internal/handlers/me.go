@@ -1,26 +1,259 @@
 package handlers
 
 import (
+    "encoding/json"
+    "errors"
+    "fmt"
     "net/http"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
 
     "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "smart-transit-system/internal/audit"
     "smart-transit-system/internal/auth"
+    "smart-transit-system/internal/httperr"
+    "smart-transit-system/internal/models"
+    "smart-transit-system/internal/scim"
 )
 
-// Me returns authenticated user's token-derived profile.
-func Me(c *gin.Context) {
-    claims, ok := auth.FromContext(c)
-    if !ok {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "no auth context"})
-        return
+// Me returns the authenticated user's persisted profile merged with
+// token-derived claims; service callers get their client identity instead.
+// db may be nil when the database is unavailable, in which case only the
+// token view is returned.
+func Me(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        claims, ok := auth.FromContext(c)
+        if !ok {
+            httperr.JSON(c, http.StatusUnauthorized, "no auth context")
+            return
+        }
+        if p, ok := auth.PrincipalFromContext(c); ok && p.IsService() {
+            c.JSON(http.StatusOK, gin.H{
+                "kind":      p.Kind,
+                "sub":       p.Subject,
+                "client_id": p.ClientID,
+                "scopes":    claims.Scopes(),
+            })
+            return
+        }
+        resp := gin.H{
+            "kind":          auth.PrincipalUser,
+            "sub":           claims.Subject(),
+            "email":         claims.Email(),
+            "scopes":        claims.Scopes(),
+            "roles":         claims.Roles(),
+            "transit_roles": claims.TransitRoles(),
+            "claims":        claims, // include full map for now; can trim later
+        }
+        if userID, ok := auth.UserIDFromContext(c); ok && db != nil {
+            var user models.User
+            if err := db.WithContext(c.Request.Context()).First(&user, "id = ?", userID).Error; err == nil {
+                resp["id"] = user.ID
+                resp["profile"] = userView(&user)
+                c.Header("ETag", meETag(&user))
+                if user.Email != "" {
+                    resp["email"] = user.Email
+                }
+            }
+        }
+        c.JSON(http.StatusOK, resp)
     }
-    resp := gin.H{
-        "sub":    claims.Subject(),
-        "email":  claims.Email(),
-        "scopes": claims.Scopes(),
-        "roles":  claims.Roles(),
-        "claims": claims, // include full map for now; can trim later
+}
+
+// userView is the public JSON shape of a local user row.
+func userView(u *models.User) gin.H {
+    return gin.H{
+        "id":         u.ID,
+        "sub":        u.Sub,
+        "issuer":     u.Issuer,
+        "email":      u.Email,
+        "phone":      u.Phone,
+        "first_name": u.FirstName,
+        "last_name":  u.LastName,
+        "status":     u.Status,
+        "missing_upstream_at": u.MissingUpstreamAt,
+        "created_at": u.CreatedAt,
+        "updated_at": u.UpdatedAt,
+    }
+}
+
+// meETag derives a strong ETag from the row's UpdatedAt for optimistic
+// concurrency; If-Match needs a strong validator (RFC 9110 §13.1.1).
+func meETag(u *models.User) string {
+    return fmt.Sprintf(`"%d"`, u.UpdatedAt.UnixMicro())
+}
+
+// ifMatches applies If-Match with strong comparison: "*" or one of the
+// listed tags equal to etag. Weak tags never match.
+func ifMatches(header, etag string) bool {
+    for _, tag := range strings.Split(header, ",") {
+        tag = strings.TrimSpace(tag)
+        if tag == "*" || tag == etag {
+            return true
+        }
     }
-    c.JSON(http.StatusOK, resp)
+    return false
 }
 
+type updateMeRequest struct {
+    FirstName *string `json:"first_name"`
+    LastName  *string `json:"last_name"`
+    Phone     *string `json:"phone"`
+}
+
+// UpdateMe lets the signed-in user edit their first name, last name and
+// phone. The request must carry If-Match with the ETag from GET /me; every
+// change is recorded in user_audits with a before/after diff and queued for
+// the IdP through the SCIM outbox.
+func UpdateMe(db *gorm.DB, outbox *scim.Outbox) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        userID, ok := auth.UserIDFromContext(c)
+        if !ok {
+            httperr.JSON(c, http.StatusUnauthorized, "no auth context")
+            return
+        }
+        ifMatch := c.GetHeader("If-Match")
+        if ifMatch == "" {
+            httperr.JSON(c, http.StatusPreconditionRequired, "If-Match header required")
+            return
+        }
+
+        var req updateMeRequest
+        dec := json.NewDecoder(c.Request.Body)
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&req); err != nil {
+            httperr.JSON(c, http.StatusBadRequest, "invalid body: "+err.Error())
+            return
+        }
+
+        ctx := c.Request.Context()
+        var user models.User
+        if err := db.WithContext(ctx).First(&user, "id = ?", userID).Error; err != nil {
+            httperr.JSON(c, http.StatusNotFound, "user not found")
+            return
+        }
+        if !ifMatches(ifMatch, meETag(&user)) {
+            c.Header("ETag", meETag(&user))
+            httperr.JSON(c, http.StatusPreconditionFailed, "profile was modified; reload and retry")
+            return
+        }
+
+        changes := map[string]any{}
+        diff := map[string]any{}
+        fieldErrs := gin.H{}
+        set := func(col, current string, next *string, normalize func(string) (string, error)) {
+            if next == nil {
+                return
+            }
+            v, err := normalize(*next)
+            if err != nil {
+                fieldErrs[col] = err.Error()
+                return
+            }
+            if v != current {
+                changes[col] = v
+                diff[col] = map[string]string{"from": current, "to": v}
+            }
+        }
+        set("first_name", user.FirstName, req.FirstName, normalizeName)
+        set("last_name", user.LastName, req.LastName, normalizeName)
+        set("phone", user.Phone, req.Phone, normalizePhone)
+        if len(fieldErrs) > 0 {
+            httperr.JSONCode(c, http.StatusUnprocessableEntity, "validation_failed", "validation failed", gin.H{"fields": fieldErrs})
+            return
+        }
+        if len(changes) == 0 {
+            c.Header("ETag", meETag(&user))
+            c.JSON(http.StatusOK, userView(&user))
+            return
+        }
+
+        // Conditional update guards against a concurrent edit between the
+        // read above and this write.
+        changes["updated_at"] = time.Now()
+        updated := false
+        err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+            res := tx.Model(&models.User{}).
+                Where("id = ? AND updated_at = ?", user.ID, user.UpdatedAt).
+                Updates(changes)
+            if res.Error != nil || res.RowsAffected == 0 {
+                return res.Error
+            }
+            updated = true
+            return outbox.Enqueue(tx, scim.UserSync(user.ID))
+        })
+        if err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "update failed")
+            return
+        }
+        if !updated {
+            httperr.JSON(c, http.StatusPreconditionFailed, "profile was modified; reload and retry")
+            return
+        }
+        audit.Write(db.WithContext(ctx), user.ID, user.ID, "profile_updated", diff)
+
+        if err := db.WithContext(ctx).First(&user, "id = ?", user.ID).Error; err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "reload failed")
+            return
+        }
+        c.Header("ETag", meETag(&user))
+        c.JSON(http.StatusOK, userView(&user))
+    }
+}
+
+const maxNameLen = 64
+
+// normalizeName trims whitespace and enforces 1..64 printable characters.
+func normalizeName(s string) (string, error) {
+    s = strings.TrimSpace(s)
+    n := utf8.RuneCountInString(s)
+    if n == 0 {
+        return "", errors.New("must not be empty")
+    }
+    if n > maxNameLen {
+        return "", fmt.Errorf("must be at most %d characters", maxNameLen)
+    }
+    for _, r := range s {
+        if unicode.IsControl(r) {
+            return "", errors.New("contains control characters")
+        }
+    }
+    return s, nil
+}
+
+// normalizePhone converts common formatting to E.164 (+<country><number>).
+// An empty string clears the phone number.
+func normalizePhone(s string) (string, error) {
+    s = strings.TrimSpace(s)
+    if s == "" {
+        return "", nil
+    }
+    var b strings.Builder
+    for i, r := range s {
+        switch {
+        case r >= '0' && r <= '9':
+            b.WriteRune(r)
+        case r == '+' && i == 0:
+            b.WriteRune(r)
+        case r == ' ' || r == '-' || r == '(' || r == ')' || r == '.':
+            // formatting characters are dropped
+        default:
+            return "", errors.New("invalid character in phone number")
+        }
+    }
+    p := b.String()
+    if strings.HasPrefix(p, "00") {
+        p = "+" + p[2:]
+    }
+    if !strings.HasPrefix(p, "+") {
+        return "", errors.New("must include country code, e.g. +94771234567")
+    }
+    digits := p[1:]
+    if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+        return "", errors.New("not a valid E.164 number")
+    }
+    return p, nil
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+    "errors"
+    "net/http"
+    "regexp"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+    "smart-transit-system/internal/audit"
+    "smart-transit-system/internal/auth"
+    "smart-transit-system/internal/httperr"
+    "smart-transit-system/internal/models"
+    "smart-transit-system/internal/scim"
+)
+
+var orgRolePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,31}$`)
+
+func membershipView(m *models.UserOrgMembership) gin.H {
+    return gin.H{
+        "id":          m.ID,
+        "user_id":     m.UserID,
+        "org_id":      m.OrgID,
+        "role":        m.Role,
+        "assigned_at": m.AssignedAt,
+    }
+}
+
+// OrgAdminOrScope allows the request when the token holds the global scope,
+// or when the caller is an admin member of the org in the :id route param.
+func OrgAdminOrScope(orgRoles *auth.OrgRoles, scope string) gin.HandlerFunc {
+    requireAdmin := orgRoles.RequireOrgRole("id", models.OrgRoleAdmin)
+    return func(c *gin.Context) {
+        if claims, ok := auth.FromContext(c); ok {
+            for _, s := range claims.Scopes() {
+                if s == scope {
+                    c.Next()
+                    return
+                }
+            }
+        }
+        requireAdmin(c)
+    }
+}
+
+// ListOrgMembers lists the members of an organization.
+func ListOrgMembers(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        org, ok := loadOrg(c, db)
+        if !ok {
+            return
+        }
+        page, size := pagination(c)
+        q := db.WithContext(c.Request.Context()).Model(&models.UserOrgMembership{}).Where("org_id = ?", org.ID)
+        if role := c.Query("role"); role != "" {
+            q = q.Where("role = ?", role)
+        }
+        var total int64
+        if err := q.Count(&total).Error; err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "list failed")
+            return
+        }
+        var rows []models.UserOrgMembership
+        if err := q.Order("assigned_at, id").Offset((page - 1) * size).Limit(size).Find(&rows).Error; err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "list failed")
+            return
+        }
+        items := make([]gin.H, 0, len(rows))
+        for i := range rows {
+            items = append(items, membershipView(&rows[i]))
+        }
+        c.JSON(http.StatusOK, gin.H{"items": items, "page": page, "page_size": size, "total": total})
+    }
+}
+
+type memberRequest struct {
+    UserID string `json:"user_id"`
+    Role   string `json:"role"`
+}
+
+// AddOrgMember adds a user to an organization with the given role and
+// queues the matching IdP group membership.
+func AddOrgMember(db *gorm.DB, outbox *scim.Outbox) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req memberRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            httperr.JSON(c, http.StatusBadRequest, "invalid body: "+err.Error())
+            return
+        }
+        req.Role = strings.ToLower(strings.TrimSpace(req.Role))
+        if !orgRolePattern.MatchString(req.Role) {
+            httperr.JSON(c, http.StatusUnprocessableEntity, "role must be 2-32 lowercase letters, digits or underscores")
+            return
+        }
+        org, ok := loadWritableOrg(c, db)
+        if !ok {
+            return
+        }
+        ctx := c.Request.Context()
+        var user models.User
+        if err := db.WithContext(ctx).First(&user, "id = ?", req.UserID).Error; err != nil {
+            httperr.JSON(c, http.StatusNotFound, "user not found")
+            return
+        }
+        m := models.UserOrgMembership{UserID: user.ID, OrgID: org.ID, Role: req.Role}
+        created := false
+        err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+            res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&m)
+            if res.Error != nil || res.RowsAffected == 0 {
+                return res.Error
+            }
+            created = true
+            return outbox.Enqueue(tx, scim.GroupAdd(user.ID, org.ID, m.Role))
+        })
+        if err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "create failed")
+            return
+        }
+        if !created {
+            httperr.JSON(c, http.StatusConflict, "user is already a member of this organization")
+            return
+        }
+        actorID, _ := auth.UserIDFromContext(c)
+        audit.Write(db.WithContext(ctx), user.ID, actorID, "membership_added", gin.H{"org_id": org.ID, "role": m.Role})
+        c.JSON(http.StatusCreated, membershipView(&m))
+    }
+}
+
+// UpdateOrgMember changes a member's role within an organization.
+func UpdateOrgMember(db *gorm.DB, outbox *scim.Outbox) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req memberRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            httperr.JSON(c, http.StatusBadRequest, "invalid body: "+err.Error())
+            return
+        }
+        req.Role = strings.ToLower(strings.TrimSpace(req.Role))
+        if !orgRolePattern.MatchString(req.Role) {
+            httperr.JSON(c, http.StatusUnprocessableEntity, "role must be 2-32 lowercase letters, digits or underscores")
+            return
+        }
+        org, ok := loadWritableOrg(c, db)
+        if !ok {
+            return
+        }
+        m, ok := loadMembership(c, db, org.ID)
+        if !ok {
+            return
+        }
+        if m.Role == req.Role {
+            c.JSON(http.StatusOK, membershipView(m))
+            return
+        }
+        ctx := c.Request.Context()
+        prev := m.Role
+        err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+            if err := tx.Model(m).Update("role", req.Role).Error; err != nil {
+                return err
+            }
+            return outbox.Enqueue(tx, scim.GroupRemove(m.UserID, org.ID, prev), scim.GroupAdd(m.UserID, org.ID, req.Role))
+        })
+        if err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "update failed")
+            return
+        }
+        actorID, _ := auth.UserIDFromContext(c)
+        audit.Write(db.WithContext(ctx), m.UserID, actorID, "membership_role_changed", gin.H{"org_id": org.ID, "from": prev, "to": req.Role})
+        c.JSON(http.StatusOK, membershipView(m))
+    }
+}
+
+// RemoveOrgMember removes a user from an organization.
+func RemoveOrgMember(db *gorm.DB, outbox *scim.Outbox) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        org, ok := loadWritableOrg(c, db)
+        if !ok {
+            return
+        }
+        m, ok := loadMembership(c, db, org.ID)
+        if !ok {
+            return
+        }
+        ctx := c.Request.Context()
+        err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+            if err := tx.Delete(m).Error; err != nil {
+                return err
+            }
+            return outbox.Enqueue(tx, scim.GroupRemove(m.UserID, org.ID, m.Role))
+        })
+        if err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "delete failed")
+            return
+        }
+        actorID, _ := auth.UserIDFromContext(c)
+        audit.Write(db.WithContext(ctx), m.UserID, actorID, "membership_removed", gin.H{"org_id": org.ID, "role": m.Role})
+        c.Status(http.StatusNoContent)
+    }
+}
+
+// ListUserOrgs lists the organizations a user belongs to. The user is taken
+// from the :user_id route param, or the caller when the param is absent.
+func ListUserOrgs(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        userID := c.Param("user_id")
+        if userID == "" {
+            userID, _ = auth.UserIDFromContext(c)
+        }
+        type row struct {
+            models.Organization
+            Role         string
+            MembershipID string
+        }
+        var rows []row
+        err := db.WithContext(c.Request.Context()).
+            Table("user_org_memberships AS m").
+            Select("o.*, m.role AS role, m.id AS membership_id").
+            Joins("JOIN organizations AS o ON o.id = m.org_id").
+            Where("m.user_id = ?", userID).
+            Order("o.name").
+            Scan(&rows).Error
+        if err != nil && !isInvalidUUID(err) {
+            httperr.JSON(c, http.StatusInternalServerError, "list failed")
+            return
+        }
+        items := make([]gin.H, 0, len(rows))
+        for i := range rows {
+            v := orgView(&rows[i].Organization)
+            v["role"] = rows[i].Role
+            v["membership_id"] = rows[i].MembershipID
+            items = append(items, v)
+        }
+        c.JSON(http.StatusOK, gin.H{"items": items})
+    }
+}
+
+// loadWritableOrg loads the :id org and rejects archived ones.
+func loadWritableOrg(c *gin.Context, db *gorm.DB) (*models.Organization, bool) {
+    org, ok := loadOrg(c, db)
+    if !ok {
+        return nil, false
+    }
+    if org.Status == models.OrgStatusArchived {
+        httperr.JSON(c, http.StatusConflict, "organization is archived")
+        return nil, false
+    }
+    return org, true
+}
+
+// loadMembership fetches the membership for the :user_id route param.
+func loadMembership(c *gin.Context, db *gorm.DB, orgID string) (*models.UserOrgMembership, bool) {
+    var m models.UserOrgMembership
+    err := db.WithContext(c.Request.Context()).
+        Where("org_id = ? AND user_id = ?", orgID, c.Param("user_id")).
+        First(&m).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) || (err != nil && isInvalidUUID(err)) {
+        httperr.JSON(c, http.StatusNotFound, "membership not found")
+        return nil, false
+    }
+    if err != nil {
+        httperr.JSON(c, http.StatusInternalServerError, "lookup failed")
+        return nil, false
+    }
+    return &m, true
+}
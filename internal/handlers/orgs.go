@@ -0,0 +1,290 @@
+package handlers
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+    "smart-transit-system/internal/httperr"
+    "smart-transit-system/internal/models"
+    "smart-transit-system/internal/scim"
+)
+
+var validOrgTypes = map[string]bool{
+    models.OrgTypeCompany: true,
+    models.OrgTypeLounge:  true,
+    models.OrgTypeSystem:  true,
+}
+
+var validOrgStatuses = map[string]bool{
+    models.OrgStatusActive:    true,
+    models.OrgStatusSuspended: true,
+    models.OrgStatusArchived:  true,
+}
+
+// orgTransitions lists the allowed status changes; archived is terminal.
+var orgTransitions = map[string][]string{
+    models.OrgStatusActive:    {models.OrgStatusSuspended, models.OrgStatusArchived},
+    models.OrgStatusSuspended: {models.OrgStatusActive, models.OrgStatusArchived},
+}
+
+func orgView(o *models.Organization) gin.H {
+    return gin.H{
+        "id":         o.ID,
+        "type":       o.Type,
+        "name":       o.Name,
+        "status":     o.Status,
+        "created_at": o.CreatedAt,
+        "updated_at": o.UpdatedAt,
+    }
+}
+
+// pagination reads page/page_size query params (defaults 1 and 20, max 100).
+func pagination(c *gin.Context) (page, size int) {
+    page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+    size, _ = strconv.Atoi(c.DefaultQuery("page_size", "20"))
+    if page < 1 {
+        page = 1
+    }
+    if size < 1 {
+        size = 20
+    }
+    if size > 100 {
+        size = 100
+    }
+    return page, size
+}
+
+// loadOrg fetches the org named by the :id route param, writing 404/500 on failure.
+func loadOrg(c *gin.Context, db *gorm.DB) (*models.Organization, bool) {
+    var org models.Organization
+    err := db.WithContext(c.Request.Context()).First(&org, "id = ?", c.Param("id")).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) || (err != nil && isInvalidUUID(err)) {
+        httperr.JSON(c, http.StatusNotFound, "organization not found")
+        return nil, false
+    }
+    if err != nil {
+        httperr.JSON(c, http.StatusInternalServerError, "lookup failed")
+        return nil, false
+    }
+    return &org, true
+}
+
+// isInvalidUUID reports a Postgres invalid_text_representation error, raised
+// when a malformed id is compared with a uuid column.
+func isInvalidUUID(err error) bool {
+    return strings.Contains(err.Error(), "SQLSTATE 22P02")
+}
+
+type orgRequest struct {
+    Type string `json:"type"`
+    Name string `json:"name"`
+}
+
+// CreateOrg creates a company, lounge or system organization.
+func CreateOrg(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req orgRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            httperr.JSON(c, http.StatusBadRequest, "invalid body: "+err.Error())
+            return
+        }
+        req.Type = strings.ToLower(strings.TrimSpace(req.Type))
+        if !validOrgTypes[req.Type] {
+            httperr.JSON(c, http.StatusUnprocessableEntity, "type must be one of company, lounge, system")
+            return
+        }
+        name, err := normalizeOrgName(req.Name)
+        if err != nil {
+            httperr.JSON(c, http.StatusUnprocessableEntity, "name " + err.Error())
+            return
+        }
+        org := models.Organization{Type: req.Type, Name: name, Status: models.OrgStatusActive}
+        if err := db.WithContext(c.Request.Context()).Create(&org).Error; err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "create failed")
+            return
+        }
+        c.JSON(http.StatusCreated, orgView(&org))
+    }
+}
+
+// ListOrgs lists organizations with optional type/status filters and pagination.
+func ListOrgs(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        page, size := pagination(c)
+        q := db.WithContext(c.Request.Context()).Model(&models.Organization{})
+        if t := strings.ToLower(strings.TrimSpace(c.Query("type"))); t != "" {
+            if !validOrgTypes[t] {
+                httperr.JSON(c, http.StatusBadRequest, "invalid type filter")
+                return
+            }
+            q = q.Where("type = ?", t)
+        }
+        if st := c.Query("status"); st != "" {
+            if !validOrgStatuses[st] {
+                httperr.JSON(c, http.StatusBadRequest, "invalid status filter")
+                return
+            }
+            q = q.Where("status = ?", st)
+        }
+        var total int64
+        if err := q.Count(&total).Error; err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "list failed")
+            return
+        }
+        var orgs []models.Organization
+        if err := q.Order("created_at DESC, id").Offset((page - 1) * size).Limit(size).Find(&orgs).Error; err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "list failed")
+            return
+        }
+        items := make([]gin.H, 0, len(orgs))
+        for i := range orgs {
+            items = append(items, orgView(&orgs[i]))
+        }
+        c.JSON(http.StatusOK, gin.H{"items": items, "page": page, "page_size": size, "total": total})
+    }
+}
+
+// GetOrg returns a single organization.
+func GetOrg(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        org, ok := loadOrg(c, db)
+        if !ok {
+            return
+        }
+        c.JSON(http.StatusOK, orgView(org))
+    }
+}
+
+// UpdateOrg renames an organization. Type is immutable; status changes go
+// through UpdateOrgStatus so transitions are validated.
+func UpdateOrg(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req orgRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            httperr.JSON(c, http.StatusBadRequest, "invalid body: "+err.Error())
+            return
+        }
+        if req.Type != "" {
+            httperr.JSON(c, http.StatusUnprocessableEntity, "type cannot be changed")
+            return
+        }
+        name, err := normalizeOrgName(req.Name)
+        if err != nil {
+            httperr.JSON(c, http.StatusUnprocessableEntity, "name " + err.Error())
+            return
+        }
+        org, ok := loadOrg(c, db)
+        if !ok {
+            return
+        }
+        if org.Status == models.OrgStatusArchived {
+            httperr.JSON(c, http.StatusConflict, "organization is archived")
+            return
+        }
+        if err := db.WithContext(c.Request.Context()).Model(org).Update("name", name).Error; err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "update failed")
+            return
+        }
+        c.JSON(http.StatusOK, orgView(org))
+    }
+}
+
+// UpdateOrgStatus moves an organization between active, suspended and archived.
+func UpdateOrgStatus(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req struct {
+            Status string `json:"status"`
+        }
+        if err := c.ShouldBindJSON(&req); err != nil {
+            httperr.JSON(c, http.StatusBadRequest, "invalid body: "+err.Error())
+            return
+        }
+        req.Status = strings.ToLower(strings.TrimSpace(req.Status))
+        if !validOrgStatuses[req.Status] {
+            httperr.JSON(c, http.StatusUnprocessableEntity, "status must be one of active, suspended, archived")
+            return
+        }
+        org, ok := loadOrg(c, db)
+        if !ok {
+            return
+        }
+        if req.Status == org.Status {
+            c.JSON(http.StatusOK, orgView(org))
+            return
+        }
+        allowed := false
+        for _, s := range orgTransitions[org.Status] {
+            if s == req.Status {
+                allowed = true
+                break
+            }
+        }
+        if !allowed {
+            httperr.JSON(c, http.StatusConflict, "cannot change status from " + org.Status + " to " + req.Status)
+            return
+        }
+        res := db.WithContext(c.Request.Context()).Model(org).Where("status = ?", org.Status).Update("status", req.Status)
+        if res.Error != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "update failed")
+            return
+        }
+        if res.RowsAffected == 0 {
+            httperr.JSON(c, http.StatusConflict, "status changed concurrently; reload and retry")
+            return
+        }
+        c.JSON(http.StatusOK, orgView(org))
+    }
+}
+
+// DeleteOrg permanently removes an organization. Only archived orgs can be
+// deleted so an active operator is never removed by accident. Members are
+// removed from the org's IdP groups through the SCIM outbox.
+func DeleteOrg(db *gorm.DB, outbox *scim.Outbox) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        org, ok := loadOrg(c, db)
+        if !ok {
+            return
+        }
+        if org.Status != models.OrgStatusArchived {
+            httperr.JSON(c, http.StatusConflict, "archive the organization before deleting it")
+            return
+        }
+        err := db.WithContext(c.Request.Context()).Transaction(func(tx *gorm.DB) error {
+            var removed []models.UserOrgMembership
+            if err := tx.Clauses(clause.Returning{}).Where("org_id = ?", org.ID).Delete(&removed).Error; err != nil {
+                return err
+            }
+            changes := make([]models.ScimOutbox, 0, len(removed))
+            for _, m := range removed {
+                changes = append(changes, scim.GroupRemove(m.UserID, org.ID, m.Role))
+            }
+            if err := outbox.Enqueue(tx, changes...); err != nil {
+                return err
+            }
+            return tx.Delete(org).Error
+        })
+        if err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "delete failed")
+            return
+        }
+        c.Status(http.StatusNoContent)
+    }
+}
+
+const maxOrgNameLen = 128
+
+func normalizeOrgName(s string) (string, error) {
+    s = strings.TrimSpace(s)
+    if s == "" {
+        return "", errors.New("is required")
+    }
+    if len([]rune(s)) > maxOrgNameLen {
+        return "", errors.New("must be at most 128 characters")
+    }
+    return s, nil
+}
@@ -3,14 +3,22 @@ package handlers
 import (
     "net/http"
     "github.com/gin-gonic/gin"
+
+    "smart-transit-system/internal/auth"
+    "smart-transit-system/internal/scim"
 )
 
-// Ready returns a simple readiness payload.
-func Ready(authConfigured bool, issuer string, authError string) gin.HandlerFunc {
+// Ready returns a simple readiness payload, including the IdP user
+// reconciliation status when reconciler is not nil.
+func Ready(authConfigured bool, issuer string, authError string, reconciler *scim.Reconciler) gin.HandlerFunc {
     return func(c *gin.Context) {
         resp := gin.H{
             "auth_configured": authConfigured,
             "issuer":          issuer,
+            "auth_failures":   auth.FailureCounts(),
+        }
+        if reconciler != nil {
+            resp["idp_reconcile"] = reconciler.Status()
         }
         if !authConfigured && authError != "" {
             resp["error"] = authError
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "smart-transit-system/internal/audit"
+    "smart-transit-system/internal/auth"
+    "smart-transit-system/internal/httperr"
+    "smart-transit-system/internal/models"
+    "smart-transit-system/internal/scim"
+)
+
+type revokeRequest struct {
+    JTI       string     `json:"jti"`
+    ExpiresAt *time.Time `json:"expires_at"` // jti: the token's exp, if known
+    UserID    string     `json:"user_id"`
+    Sub       string     `json:"sub"`
+    Issuer    string     `json:"issuer"` // with sub or sid: its issuer; empty for the primary issuer
+    Before    *time.Time `json:"before"` // user: revoke tokens issued before this; defaults to now
+    SID       string     `json:"sid"`
+    Reason    string     `json:"reason"`
+}
+
+// RevokeTokens adds a local revocation for one token (jti), all current
+// tokens of a user (user_id or sub), or an IdP session (sid).
+func RevokeTokens(db *gorm.DB, rev *auth.Revocations) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req revokeRequest
+        if err := c.ShouldBindJSON(&req); err != nil {
+            httperr.JSON(c, http.StatusBadRequest, "invalid body: "+err.Error())
+            return
+        }
+        set := 0
+        for _, v := range []string{req.JTI, req.UserID + req.Sub, req.SID} {
+            if strings.TrimSpace(v) != "" {
+                set++
+            }
+        }
+        if set != 1 {
+            httperr.JSON(c, http.StatusUnprocessableEntity, "exactly one of jti, user_id/sub or sid is required")
+            return
+        }
+        ctx := c.Request.Context()
+        actorID, _ := auth.UserIDFromContext(c)
+        var resp gin.H
+        userID := ""
+        var err error
+        switch {
+        case req.JTI != "":
+            var exp time.Time
+            if req.ExpiresAt != nil {
+                exp = *req.ExpiresAt
+            }
+            err = rev.RevokeJTI(ctx, req.JTI, exp, actorID, req.Reason)
+            resp = gin.H{"kind": models.RevokeJTI, "value": req.JTI}
+        case req.SID != "":
+            err = rev.RevokeSID(ctx, req.Issuer, req.SID, actorID, req.Reason)
+            resp = gin.H{"kind": models.RevokeSID, "value": auth.SubjectKey(req.Issuer, req.SID)}
+        default:
+            var user models.User
+            q := db.WithContext(ctx)
+            if req.UserID != "" {
+                q = q.Where("id = ?", req.UserID)
+            } else {
+                q = q.Where("issuer = ? AND sub = ?", req.Issuer, req.Sub)
+            }
+            if e := q.First(&user).Error; e != nil {
+                httperr.JSON(c, http.StatusNotFound, "user not found")
+                return
+            }
+            before := time.Now()
+            if req.Before != nil {
+                before = *req.Before
+            }
+            userID = user.ID
+            err = rev.RevokeSubject(ctx, user.Issuer, user.Sub, before, actorID, req.Reason)
+            resp = gin.H{"kind": models.RevokeSubject, "value": auth.SubjectKey(user.Issuer, user.Sub), "user_id": user.ID, "revoked_before": before}
+        }
+        if err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "revocation failed")
+            return
+        }
+        details := gin.H{"reason": req.Reason}
+        for k, v := range resp {
+            details[k] = v
+        }
+        audit.Write(db.WithContext(ctx), userID, actorID, "tokens_revoked", details)
+        c.JSON(http.StatusCreated, resp)
+    }
+}
+
+var validUserStatuses = map[string]bool{
+    models.UserStatusActive:    true,
+    models.UserStatusSuspended: true,
+    models.UserStatusInactive:  true,
+}
+
+// UpdateUserStatus activates, suspends or deactivates a user. Requests from
+// non-active users are rejected by the auth middleware, and the IdP account
+// is (de)activated through the SCIM outbox.
+func UpdateUserStatus(db *gorm.DB, rev *auth.Revocations, outbox *scim.Outbox) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var req struct {
+            Status string `json:"status"`
+        }
+        if err := c.ShouldBindJSON(&req); err != nil {
+            httperr.JSON(c, http.StatusBadRequest, "invalid body: "+err.Error())
+            return
+        }
+        if !validUserStatuses[req.Status] {
+            httperr.JSON(c, http.StatusUnprocessableEntity, "status must be one of active, suspended, inactive")
+            return
+        }
+        ctx := c.Request.Context()
+        var user models.User
+        if err := db.WithContext(ctx).First(&user, "id = ?", c.Param("user_id")).Error; err != nil {
+            httperr.JSON(c, http.StatusNotFound, "user not found")
+            return
+        }
+        from := user.Status
+        if from != req.Status {
+            err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+                if err := tx.Model(&user).Update("status", req.Status).Error; err != nil {
+                    return err
+                }
+                return outbox.Enqueue(tx, scim.UserSync(user.ID))
+            })
+            if err != nil {
+                httperr.JSON(c, http.StatusInternalServerError, "update failed")
+                return
+            }
+            rev.SetUserStatus(user.Issuer, user.Sub, req.Status)
+            actorID, _ := auth.UserIDFromContext(c)
+            audit.Write(db.WithContext(ctx), user.ID, actorID, "status_changed", gin.H{"from": from, "to": req.Status})
+        }
+        c.JSON(http.StatusOK, gin.H{"id": user.ID, "sub": user.Sub, "status": req.Status})
+    }
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+    "errors"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "smart-transit-system/internal/httperr"
+    "smart-transit-system/internal/models"
+)
+
+// GetUser returns a user's profile by local id, or by sub when called as
+// /users?sub=...[&issuer=...] (for internal services that only know the
+// token subject; issuer defaults to the primary one).
+func GetUser(db *gorm.DB) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        q := db.WithContext(c.Request.Context())
+        if id := c.Param("user_id"); id != "" {
+            q = q.Where("id = ?", id)
+        } else if sub := c.Query("sub"); sub != "" {
+            q = q.Where("issuer = ? AND sub = ?", c.Query("issuer"), sub)
+        } else {
+            httperr.JSON(c, http.StatusBadRequest, "user_id or sub is required")
+            return
+        }
+        var user models.User
+        err := q.First(&user).Error
+        if errors.Is(err, gorm.ErrRecordNotFound) || (err != nil && isInvalidUUID(err)) {
+            httperr.JSON(c, http.StatusNotFound, "user not found")
+            return
+        }
+        if err != nil {
+            httperr.JSON(c, http.StatusInternalServerError, "lookup failed")
+            return
+        }
+        c.JSON(http.StatusOK, userView(&user))
+    }
+}
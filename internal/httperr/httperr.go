@@ -0,0 +1,65 @@
+package httperr
+
+import (
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+// The error envelope used by every endpoint:
+//
+//   {"error": "<machine readable code>", "message": "<human readable text>"}
+//
+// Extra fields (e.g. per-field validation errors) may be added alongside.
+
+// codes maps HTTP statuses to the default error code.
+var codes = map[int]string{
+    http.StatusBadRequest:           "invalid_request",
+    http.StatusUnauthorized:         "unauthorized",
+    http.StatusForbidden:            "forbidden",
+    http.StatusNotFound:             "not_found",
+    http.StatusConflict:             "conflict",
+    http.StatusPreconditionFailed:   "precondition_failed",
+    http.StatusUnprocessableEntity:  "validation_failed",
+    http.StatusPreconditionRequired: "precondition_required",
+    http.StatusInternalServerError:  "internal_error",
+    http.StatusBadGateway:           "bad_gateway",
+    http.StatusServiceUnavailable:   "service_unavailable",
+}
+
+// Code returns the default error code for an HTTP status.
+func Code(status int) string {
+    if c, ok := codes[status]; ok {
+        return c
+    }
+    return "error"
+}
+
+// Body builds the envelope with optional extra fields.
+func Body(code, message string, extra gin.H) gin.H {
+    b := gin.H{"error": code, "message": message}
+    for k, v := range extra {
+        b[k] = v
+    }
+    return b
+}
+
+// JSON writes an error with the default code for status.
+func JSON(c *gin.Context, status int, message string) {
+    c.JSON(status, Body(Code(status), message, nil))
+}
+
+// JSONCode writes an error with an explicit code and optional extra fields.
+func JSONCode(c *gin.Context, status int, code, message string, extra gin.H) {
+    c.JSON(status, Body(code, message, extra))
+}
+
+// Abort aborts the handler chain with an error using the default code.
+func Abort(c *gin.Context, status int, message string) {
+    c.AbortWithStatusJSON(status, Body(Code(status), message, nil))
+}
+
+// AbortCode aborts the handler chain with an explicit code.
+func AbortCode(c *gin.Context, status int, code, message string, extra gin.H) {
+    c.AbortWithStatusJSON(status, Body(code, message, extra))
+}
@@ -39,7 +39,8 @@ func CORS() gin.HandlerFunc {
         c.Header("Access-Control-Allow-Origin", allowOrigin)
         c.Header("Vary", "Origin")
         c.Header("Access-Control-Allow-Credentials", "true")
-        c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type")
+        c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, X-CSRF-Token, If-Match, DPoP")
+        c.Header("Access-Control-Expose-Headers", "ETag, WWW-Authenticate")
         c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 
         if c.Request.Method == http.MethodOptions {
@@ -0,0 +1,14 @@
+package models
+
+import (
+    "time"
+)
+
+// DPoPProof records a used DPoP proof jti so replays are rejected across
+// replicas. Rows are deleted once the proof would be too old anyway.
+type DPoPProof struct {
+    JTI       string    `gorm:"primaryKey"` // SHA-256 of the key thumbprint and jti
+    ExpiresAt time.Time `gorm:"index;not null"`
+}
+
+func (DPoPProof) TableName() string { return "dpop_proofs" }
@@ -0,0 +1,32 @@
+package models
+
+import (
+    "time"
+)
+
+// Token revocation kinds.
+const (
+    RevokeJTI     = "jti" // a single token
+    RevokeSubject = "sub" // every token of the user issued before RevokedBefore
+    RevokeSID     = "sid" // every token of an IdP session
+)
+
+// TokenRevocation is a locally revoked token, user or session. Rows can be
+// purged after ExpiresAt, when every affected token has expired anyway.
+type TokenRevocation struct {
+    ID            string    `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+    Kind          string    `gorm:"not null;uniqueIndex:idx_revocation_kind_value"`
+    Value         string    `gorm:"not null;uniqueIndex:idx_revocation_kind_value"`
+    RevokedBefore time.Time // sub: tokens issued before this are rejected
+    ExpiresAt     time.Time `gorm:"index;not null"`
+    Reason        string
+    ActorID       string    `gorm:"type:uuid"`
+    CreatedAt     time.Time `gorm:"autoCreateTime"`
+}
+
+// User statuses; only active users may call the API.
+const (
+    UserStatusActive    = "active"
+    UserStatusSuspended = "suspended"
+    UserStatusInactive  = "inactive"
+)
@@ -0,0 +1,32 @@
+package models
+
+import (
+    "time"
+)
+
+// SCIM outbox operations.
+const (
+    ScimOpUserSync    = "user.sync"    // push the user's current profile and active flag
+    ScimOpGroupAdd    = "group.add"    // add the user to the org role's group
+    ScimOpGroupRemove = "group.remove" // remove the user from the org role's group
+)
+
+// ScimOutbox is a pending change to push to the IdP over SCIM. Rows are
+// written in the same transaction as the local change and deleted once the
+// IdP accepted it; rows that keep failing get FailedAt and stay for review.
+type ScimOutbox struct {
+    ID            int64     `gorm:"primaryKey"` // bigserial; gives the push order
+    Op            string    `gorm:"not null"`
+    UserID        string    `gorm:"type:uuid;index;not null"`
+    OrgID         string    // group ops
+    Role          string    // group ops
+    Attempts      int       `gorm:"not null;default:0"`
+    NextAttemptAt time.Time `gorm:"index;not null"`
+    LastError     string    `gorm:"type:text"`
+    FailedAt      *time.Time
+    LockedUntil   *time.Time // set while a worker pushes the change; other workers skip it until then
+    CreatedAt     time.Time `gorm:"autoCreateTime"`
+}
+
+// TableName keeps the outbox singular.
+func (ScimOutbox) TableName() string { return "scim_outbox" }
@@ -0,0 +1,21 @@
+package models
+
+import (
+    "time"
+)
+
+// Session is a server-side login session used in BFF mode. The primary key
+// is the SHA-256 of the cookie value so a database leak cannot be replayed.
+type Session struct {
+    ID           string    `gorm:"primaryKey"`
+    Sub          string    `gorm:"index;not null"`
+    SID          string    `gorm:"index"` // IdP session id (sid claim), if present
+    AccessToken  string    `gorm:"type:text;not null"`
+    RefreshToken string    `gorm:"type:text"`
+    IDToken      string    `gorm:"type:text"`
+    TokenExpiry  time.Time // access token expiry
+    CSRFToken    string    `gorm:"not null"`
+    ExpiresAt    time.Time `gorm:"index;not null"` // session (cookie) expiry
+    CreatedAt    time.Time `gorm:"autoCreateTime"`
+    UpdatedAt    time.Time `gorm:"autoUpdateTime"`
+}
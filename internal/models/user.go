@@ -6,16 +6,37 @@ import (
 
 type User struct {
     ID        string    `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-    Sub       string    `gorm:"uniqueIndex;not null"` // Asgardeo subject
+    Issuer    string    `gorm:"not null;default:'';uniqueIndex:idx_users_issuer_sub"` // token issuer; empty for the primary (Asgardeo) issuer
+    Sub       string    `gorm:"not null;uniqueIndex:idx_users_issuer_sub"` // subject at Issuer
     Email     string    `gorm:"index"`
     Phone     string
     FirstName string
     LastName  string
     Status    string    `gorm:"default:'active'"`
+    SyncedClaims string `gorm:"type:text"` // profile claims last synced by JIT provisioning (JSON)
+    ScimID    string    `gorm:"index"` // the user's id at the IdP's SCIM API, once resolved
+    UserName  string    `gorm:"index"` // userName set by an inbound SCIM tenant
+    ExternalID string   `gorm:"index"` // externalId set by an inbound SCIM tenant
+    MissingUpstreamAt *time.Time // set by reconciliation when the IdP no longer lists the user
     CreatedAt time.Time `gorm:"autoCreateTime"`
     UpdatedAt time.Time `gorm:"autoUpdateTime"`
 }
 
+// Organization types and lifecycle statuses.
+const (
+    OrgTypeCompany = "company"
+    OrgTypeLounge  = "lounge"
+    OrgTypeSystem  = "system"
+
+    OrgStatusActive    = "active"
+    OrgStatusSuspended = "suspended"
+    OrgStatusArchived  = "archived"
+
+    // Well-known org-scoped roles; other lowercase role names are allowed.
+    OrgRoleAdmin   = "admin"
+    OrgRoleManager = "manager"
+)
+
 type Organization struct {
     ID        string    `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
     Type      string    `gorm:"not null"` // company|lounge|system
@@ -27,8 +48,8 @@ type Organization struct {
 
 type UserOrgMembership struct {
     ID        string    `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-    UserID    string    `gorm:"type:uuid;index;not null"`
-    OrgID     string    `gorm:"type:uuid;index;not null"`
+    UserID    string    `gorm:"type:uuid;index;uniqueIndex:idx_membership_user_org;not null"`
+    OrgID     string    `gorm:"type:uuid;index;uniqueIndex:idx_membership_user_org;not null"`
     Role      string    `gorm:"not null"`
     AssignedAt time.Time `gorm:"autoCreateTime"`
 }
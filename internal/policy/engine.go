@@ -0,0 +1,309 @@
+package policy
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gopkg.in/yaml.v3"
+
+    "smart-transit-system/internal/auth"
+    "smart-transit-system/internal/httperr"
+)
+
+// Mode controls whether denials are enforced or only logged.
+const (
+    ModeEnforce = "enforce"
+    ModeAudit   = "audit" // dry run: log would-be denials, never block
+)
+
+// File is the on-disk policy format, JSON or (for .yaml/.yml files) YAML:
+//
+//   {
+//     "mode": "enforce",
+//     "default": "deny",
+//     "rules": [
+//       {"method": "POST", "path": "/api/v1/orgs/:org/bookings",
+//        "allow": "scope:booking.write && (role:admin || org_role:$org:manager)"}
+//     ]
+//   }
+//
+// Rules are checked in order and the first whose method and path match
+// decides. Paths support :param segments and a trailing /* wildcard.
+type File struct {
+    Mode    string     `json:"mode" yaml:"mode"`
+    Default string     `json:"default" yaml:"default"` // allow|deny when no rule matches; deny when omitted
+    Rules   []FileRule `json:"rules" yaml:"rules"`
+}
+
+type FileRule struct {
+    Method string `json:"method" yaml:"method"` // "*" or empty matches any method
+    Path   string `json:"path" yaml:"path"`
+    Allow  string `json:"allow" yaml:"allow"`
+    Mode   string `json:"mode,omitempty" yaml:"mode,omitempty"` // overrides the file mode for this rule
+}
+
+type rule struct {
+    method   string
+    segments []string
+    wildcard bool
+    src      string
+    expr     node
+    mode     string
+}
+
+type policySet struct {
+    mode         string
+    defaultAllow bool
+    rules        []rule
+}
+
+// Engine evaluates the current policy set; it is safe for concurrent use
+// and can be reloaded while serving.
+type Engine struct {
+    path     string
+    orgRoles *auth.OrgRoles
+    override string // mode forced from config, empty to use the file's
+    current  atomic.Pointer[policySet]
+    modTime  time.Time
+}
+
+// Load reads and compiles the policy file. orgRoles may be nil when org_role
+// terms are not used. modeOverride (enforce|audit) wins over the file mode.
+func Load(path string, orgRoles *auth.OrgRoles, modeOverride string) (*Engine, error) {
+    e := &Engine{path: path, orgRoles: orgRoles, override: modeOverride}
+    if err := e.Reload(); err != nil {
+        return nil, err
+    }
+    return e, nil
+}
+
+// Reload re-reads the policy file; on error the previous policy stays active.
+func (e *Engine) Reload() error {
+    st, err := os.Stat(e.path)
+    if err != nil {
+        return fmt.Errorf("policy file: %w", err)
+    }
+    b, err := os.ReadFile(e.path)
+    if err != nil {
+        return fmt.Errorf("policy file: %w", err)
+    }
+    var f File
+    switch strings.ToLower(filepath.Ext(e.path)) {
+    case ".yaml", ".yml":
+        err = yaml.Unmarshal(b, &f)
+    default:
+        err = json.Unmarshal(b, &f)
+    }
+    if err != nil {
+        return fmt.Errorf("policy file %s: %w", e.path, err)
+    }
+    ps, err := compile(f, e.override)
+    if err != nil {
+        return fmt.Errorf("policy file %s: %w", e.path, err)
+    }
+    e.current.Store(ps)
+    e.modTime = st.ModTime()
+    log.Printf("policy: loaded %d rules from %s (mode=%s, default=%s)", len(ps.rules), e.path, ps.mode, map[bool]string{true: "allow", false: "deny"}[ps.defaultAllow])
+    return nil
+}
+
+// Watch polls the policy file and reloads it when it changes, until ctx ends.
+func (e *Engine) Watch(ctx context.Context, interval time.Duration) {
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+            st, err := os.Stat(e.path)
+            if err != nil || !st.ModTime().After(e.modTime) {
+                continue
+            }
+            if err := e.Reload(); err != nil {
+                log.Printf("WARN: policy reload failed, keeping previous policy: %v", err)
+                e.modTime = st.ModTime()
+            }
+        }
+    }
+}
+
+func compile(f File, override string) (*policySet, error) {
+    mode := f.Mode
+    if override != "" {
+        mode = override
+    }
+    if mode == "" {
+        mode = ModeEnforce
+    }
+    if mode != ModeEnforce && mode != ModeAudit {
+        return nil, fmt.Errorf("invalid mode %q", mode)
+    }
+    // An incomplete file must not open unmatched routes, so allow is opt-in.
+    ps := &policySet{mode: mode, defaultAllow: f.Default == "allow"}
+    if f.Default != "" && f.Default != "allow" && f.Default != "deny" {
+        return nil, fmt.Errorf("invalid default %q", f.Default)
+    }
+    for i, fr := range f.Rules {
+        expr, err := parseExpr(fr.Allow)
+        if err != nil {
+            return nil, fmt.Errorf("rule %d (%s %s): %w", i, fr.Method, fr.Path, err)
+        }
+        if !strings.HasPrefix(fr.Path, "/") {
+            return nil, fmt.Errorf("rule %d: path must start with /", i)
+        }
+        r := rule{method: strings.ToUpper(fr.Method), src: fr.Allow, expr: expr, mode: mode}
+        if fr.Mode != "" && override == "" {
+            if fr.Mode != ModeEnforce && fr.Mode != ModeAudit {
+                return nil, fmt.Errorf("rule %d: invalid mode %q", i, fr.Mode)
+            }
+            r.mode = fr.Mode
+        }
+        p := strings.TrimRight(fr.Path, "/")
+        if strings.HasSuffix(p, "/*") {
+            r.wildcard = true
+            p = strings.TrimSuffix(p, "/*")
+        }
+        r.segments = splitPath(p)
+        ps.rules = append(ps.rules, r)
+    }
+    return ps, nil
+}
+
+func splitPath(p string) []string {
+    p = strings.Trim(p, "/")
+    if p == "" {
+        return nil
+    }
+    return strings.Split(p, "/")
+}
+
+// match reports whether the rule applies and returns bound path params.
+func (r *rule) match(method string, path []string) (map[string]string, bool) {
+    if r.method != "" && r.method != "*" && r.method != method {
+        return nil, false
+    }
+    if len(path) < len(r.segments) || (!r.wildcard && len(path) != len(r.segments)) {
+        return nil, false
+    }
+    params := map[string]string{}
+    for i, seg := range r.segments {
+        if strings.HasPrefix(seg, ":") {
+            params[seg[1:]] = path[i]
+        } else if seg != path[i] {
+            return nil, false
+        }
+    }
+    return params, true
+}
+
+// Middleware evaluates the policy for each request. Run it after the auth
+// middleware (and Provision, for org_role terms).
+func (e *Engine) Middleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        ps := e.current.Load()
+        path := splitPath(c.Request.URL.Path)
+        var matched *rule
+        var params map[string]string
+        for i := range ps.rules {
+            if p, ok := ps.rules[i].match(c.Request.Method, path); ok {
+                matched, params = &ps.rules[i], p
+                break
+            }
+        }
+        if matched == nil {
+            if ps.defaultAllow {
+                c.Next()
+                return
+            }
+            e.deny(c, ps.mode, "no matching policy rule")
+            return
+        }
+        ok, err := matched.expr.eval(&reqEnv{c: c, params: params, orgRoles: e.orgRoles})
+        if err != nil {
+            log.Printf("WARN: policy evaluation error for %s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+            ok = false
+        }
+        if !ok {
+            e.deny(c, matched.mode, matched.src)
+            return
+        }
+        c.Next()
+    }
+}
+
+func (e *Engine) deny(c *gin.Context, mode, reason string) {
+    sub := ""
+    if claims, ok := auth.FromContext(c); ok {
+        sub = claims.Subject()
+    }
+    if mode == ModeAudit {
+        log.Printf("policy: AUDIT would deny %s %s sub=%q policy=%q", c.Request.Method, c.Request.URL.Path, sub, reason)
+        c.Next()
+        return
+    }
+    log.Printf("policy: deny %s %s sub=%q policy=%q", c.Request.Method, c.Request.URL.Path, sub, reason)
+    httperr.Abort(c, http.StatusForbidden, "forbidden by policy")
+}
+
+// reqEnv adapts a gin request to the expression environment.
+type reqEnv struct {
+    c        *gin.Context
+    params   map[string]string
+    orgRoles *auth.OrgRoles
+}
+
+func (r *reqEnv) claims() auth.Claims {
+    cl, _ := auth.FromContext(r.c)
+    return cl
+}
+
+func (r *reqEnv) authenticated() bool { return r.claims().Subject() != "" }
+
+func (r *reqEnv) service() bool {
+    p, ok := auth.PrincipalFromContext(r.c)
+    return ok && p.IsService()
+}
+
+func (r *reqEnv) clientID() string { return r.claims().ClientID() }
+
+func (r *reqEnv) hasScope(s string) bool {
+    for _, x := range r.claims().Scopes() {
+        if x == s {
+            return true
+        }
+    }
+    return false
+}
+
+func (r *reqEnv) hasRole(role string) bool {
+    for _, x := range r.claims().TransitRoles() {
+        if x == role {
+            return true
+        }
+    }
+    return false
+}
+
+func (r *reqEnv) hasOrgRole(orgID, role string) (bool, error) {
+    if r.orgRoles == nil {
+        return false, fmt.Errorf("org_role used but no org role resolver configured")
+    }
+    return r.orgRoles.HasRole(r.c, orgID, role)
+}
+
+func (r *reqEnv) claim(name string) (any, bool) {
+    v, ok := r.claims()[name]
+    return v, ok
+}
+
+func (r *reqEnv) param(name string) string { return r.params[name] }
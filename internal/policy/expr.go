@@ -0,0 +1,272 @@
+package policy
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Expressions combine terms with &&, ||, ! and parentheses:
+//
+//   scope:booking.write          token has the scope
+//   role:admin                   caller maps to the transit role
+//   org_role:$org:manager        caller has the role in the org bound to :org
+//   org_role:<org-id>:admin      ...or in a fixed org
+//   claim:tenant=acme            string claim equals the value
+//   claim:email_verified         claim present and not false/empty
+//   client:booking-service       token was issued to the client id
+//   service                      caller is a service (client credentials)
+//   authenticated, true, false
+//
+// Terms may reference route params from the rule's path as $name.
+
+// env is what an expression is evaluated against.
+type env interface {
+    hasScope(s string) bool
+    hasRole(r string) bool
+    hasOrgRole(orgID, role string) (bool, error)
+    claim(name string) (any, bool)
+    authenticated() bool
+    service() bool
+    clientID() string
+    param(name string) string
+}
+
+type node interface {
+    eval(e env) (bool, error)
+}
+
+type andNode struct{ l, r node }
+type orNode struct{ l, r node }
+type notNode struct{ x node }
+type termNode struct{ kind, a, b string }
+
+func (n andNode) eval(e env) (bool, error) {
+    l, err := n.l.eval(e)
+    if err != nil || !l {
+        return false, err
+    }
+    return n.r.eval(e)
+}
+
+func (n orNode) eval(e env) (bool, error) {
+    l, err := n.l.eval(e)
+    if err != nil {
+        return false, err
+    }
+    if l {
+        return true, nil
+    }
+    return n.r.eval(e)
+}
+
+func (n notNode) eval(e env) (bool, error) {
+    v, err := n.x.eval(e)
+    return !v, err
+}
+
+func (n termNode) eval(e env) (bool, error) {
+    resolve := func(s string) string {
+        if strings.HasPrefix(s, "$") {
+            return e.param(s[1:])
+        }
+        return s
+    }
+    switch n.kind {
+    case "true":
+        return true, nil
+    case "false":
+        return false, nil
+    case "authenticated":
+        return e.authenticated(), nil
+    case "service":
+        return e.service(), nil
+    case "client":
+        return e.clientID() == resolve(n.a), nil
+    case "scope":
+        return e.hasScope(resolve(n.a)), nil
+    case "role":
+        return e.hasRole(resolve(n.a)), nil
+    case "org_role":
+        org := resolve(n.a)
+        if org == "" {
+            return false, nil
+        }
+        return e.hasOrgRole(org, resolve(n.b))
+    case "claim":
+        v, ok := e.claim(n.a)
+        if !ok {
+            return false, nil
+        }
+        if n.b == "" {
+            switch t := v.(type) {
+            case bool:
+                return t, nil
+            case string:
+                return t != "", nil
+            }
+            return v != nil, nil
+        }
+        want := resolve(n.b)
+        switch t := v.(type) {
+        case string:
+            return t == want, nil
+        case []any:
+            for _, x := range t {
+                if s, ok := x.(string); ok && s == want {
+                    return true, nil
+                }
+            }
+            return false, nil
+        default:
+            return fmt.Sprint(t) == want, nil
+        }
+    }
+    return false, fmt.Errorf("unknown term %q", n.kind)
+}
+
+// parseExpr compiles an expression string.
+func parseExpr(src string) (node, error) {
+    toks, err := tokenize(src)
+    if err != nil {
+        return nil, err
+    }
+    p := &parser{toks: toks}
+    n, err := p.or()
+    if err != nil {
+        return nil, err
+    }
+    if p.pos != len(p.toks) {
+        return nil, fmt.Errorf("unexpected %q", p.toks[p.pos])
+    }
+    return n, nil
+}
+
+func tokenize(src string) ([]string, error) {
+    var toks []string
+    for i := 0; i < len(src); {
+        ch := src[i]
+        switch {
+        case ch == ' ' || ch == '\t' || ch == '\n':
+            i++
+        case ch == '(' || ch == ')' || ch == '!':
+            toks = append(toks, string(ch))
+            i++
+        case strings.HasPrefix(src[i:], "&&") || strings.HasPrefix(src[i:], "||"):
+            toks = append(toks, src[i:i+2])
+            i += 2
+        default:
+            j := i
+            for j < len(src) && !strings.ContainsRune(" \t\n()!&|", rune(src[j])) {
+                j++
+            }
+            if j == i {
+                return nil, fmt.Errorf("unexpected %q at %d", ch, i)
+            }
+            toks = append(toks, src[i:j])
+            i = j
+        }
+    }
+    return toks, nil
+}
+
+type parser struct {
+    toks []string
+    pos  int
+}
+
+func (p *parser) peek() string {
+    if p.pos < len(p.toks) {
+        return p.toks[p.pos]
+    }
+    return ""
+}
+
+func (p *parser) or() (node, error) {
+    l, err := p.and()
+    if err != nil {
+        return nil, err
+    }
+    for p.peek() == "||" {
+        p.pos++
+        r, err := p.and()
+        if err != nil {
+            return nil, err
+        }
+        l = orNode{l, r}
+    }
+    return l, nil
+}
+
+func (p *parser) and() (node, error) {
+    l, err := p.unary()
+    if err != nil {
+        return nil, err
+    }
+    for p.peek() == "&&" {
+        p.pos++
+        r, err := p.unary()
+        if err != nil {
+            return nil, err
+        }
+        l = andNode{l, r}
+    }
+    return l, nil
+}
+
+func (p *parser) unary() (node, error) {
+    switch t := p.peek(); t {
+    case "":
+        return nil, fmt.Errorf("unexpected end of expression")
+    case "!":
+        p.pos++
+        x, err := p.unary()
+        if err != nil {
+            return nil, err
+        }
+        return notNode{x}, nil
+    case "(":
+        p.pos++
+        x, err := p.or()
+        if err != nil {
+            return nil, err
+        }
+        if p.peek() != ")" {
+            return nil, fmt.Errorf("missing )")
+        }
+        p.pos++
+        return x, nil
+    case ")", "&&", "||":
+        return nil, fmt.Errorf("unexpected %q", t)
+    default:
+        p.pos++
+        return parseTerm(t)
+    }
+}
+
+func parseTerm(t string) (node, error) {
+    switch t {
+    case "true", "false", "authenticated", "service":
+        return termNode{kind: t}, nil
+    }
+    kind, rest, ok := strings.Cut(t, ":")
+    if !ok || rest == "" {
+        return nil, fmt.Errorf("invalid term %q", t)
+    }
+    switch kind {
+    case "scope", "role", "client":
+        return termNode{kind: kind, a: rest}, nil
+    case "org_role":
+        org, role, ok := strings.Cut(rest, ":")
+        if !ok || org == "" || role == "" {
+            return nil, fmt.Errorf("invalid term %q: want org_role:<org>:<role>", t)
+        }
+        return termNode{kind: kind, a: org, b: role}, nil
+    case "claim":
+        name, val, _ := strings.Cut(rest, "=")
+        if name == "" {
+            return nil, fmt.Errorf("invalid term %q", t)
+        }
+        return termNode{kind: kind, a: name, b: val}, nil
+    }
+    return nil, fmt.Errorf("unknown term %q", t)
+}
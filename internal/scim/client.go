@@ -0,0 +1,293 @@
+// Package scim keeps users and org memberships in sync with the IdP
+// (Asgardeo) over SCIM 2.0 (RFC 7643/7644): it pushes local changes,
+// reconciles the IdP's user list back, and serves /scim/v2 for customers
+// provisioning from their own IdP.
+package scim
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+const (
+    SchemaUser      = "urn:ietf:params:scim:schemas:core:2.0:User"
+    SchemaGroup     = "urn:ietf:params:scim:schemas:core:2.0:Group"
+    SchemaPatchOp   = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+    SchemaList      = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+    SchemaError     = "urn:ietf:params:scim:api:messages:2.0:Error"
+    contentTypeSCIM = "application/scim+json"
+)
+
+// User is the subset of the SCIM core User resource this service manages.
+type User struct {
+    Schemas      []string     `json:"schemas,omitempty"`
+    ID           string       `json:"id,omitempty"`
+    ExternalID   string       `json:"externalId,omitempty"`
+    UserName     string       `json:"userName"`
+    Name         *Name        `json:"name,omitempty"`
+    Emails       []MultiValue `json:"emails,omitempty"`
+    PhoneNumbers []MultiValue `json:"phoneNumbers,omitempty"`
+    Active       *bool        `json:"active,omitempty"`
+    Groups       []MultiValue `json:"groups,omitempty"`
+    Meta         *Meta        `json:"meta,omitempty"`
+}
+
+type Name struct {
+    GivenName  string `json:"givenName,omitempty"`
+    FamilyName string `json:"familyName,omitempty"`
+}
+
+// MultiValue is a SCIM multi-valued attribute entry (emails, members, ...).
+type MultiValue struct {
+    Value   string `json:"value"`
+    Display string `json:"display,omitempty"`
+    Type    string `json:"type,omitempty"`
+    Primary bool   `json:"primary,omitempty"`
+    Ref     string `json:"$ref,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare string, which WSO2-based providers
+// return for emails.
+func (m *MultiValue) UnmarshalJSON(b []byte) error {
+    var s string
+    if json.Unmarshal(b, &s) == nil {
+        *m = MultiValue{Value: s}
+        return nil
+    }
+    type plain MultiValue
+    return json.Unmarshal(b, (*plain)(m))
+}
+
+type Meta struct {
+    ResourceType string     `json:"resourceType,omitempty"`
+    Created      *time.Time `json:"created,omitempty"`
+    LastModified *time.Time `json:"lastModified,omitempty"`
+    Location     string     `json:"location,omitempty"`
+    Version      string     `json:"version,omitempty"`
+}
+
+// Group is the SCIM core Group resource.
+type Group struct {
+    Schemas     []string     `json:"schemas,omitempty"`
+    ID          string       `json:"id,omitempty"`
+    DisplayName string       `json:"displayName"`
+    Members     []MultiValue `json:"members,omitempty"`
+    Meta        *Meta        `json:"meta,omitempty"`
+}
+
+// PatchOp is one operation of a SCIM PATCH request.
+type PatchOp struct {
+    Op    string `json:"op"`
+    Path  string `json:"path,omitempty"`
+    Value any    `json:"value,omitempty"`
+}
+
+// Error is a SCIM error response (or any non-2xx status).
+type Error struct {
+    Status   int
+    ScimType string
+    Detail   string
+}
+
+func (e *Error) Error() string {
+    if e.ScimType != "" {
+        return fmt.Sprintf("scim: status %d (%s): %s", e.Status, e.ScimType, e.Detail)
+    }
+    return fmt.Sprintf("scim: status %d: %s", e.Status, e.Detail)
+}
+
+// Temporary reports whether retrying the request later may succeed.
+func (e *Error) Temporary() bool {
+    return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// IsNotFound reports whether err is a SCIM 404.
+func IsNotFound(err error) bool {
+    var se *Error
+    return errors.As(err, &se) && se.Status == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a SCIM 409 (e.g. uniqueness).
+func IsConflict(err error) bool {
+    var se *Error
+    return errors.As(err, &se) && se.Status == http.StatusConflict
+}
+
+// Client calls a SCIM 2.0 service provider. The http.Client is expected to
+// authenticate requests, e.g. tokensource.Source.Client().
+type Client struct {
+    baseURL string
+    http    *http.Client
+}
+
+// NewClient returns a client for the SCIM base URL, e.g.
+// https://api.asgardeo.io/t/<org>/scim2.
+func NewClient(baseURL string, hc *http.Client) (*Client, error) {
+    u, err := url.Parse(baseURL)
+    if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+        return nil, fmt.Errorf("invalid SCIM base url %q", baseURL)
+    }
+    if hc == nil {
+        hc = http.DefaultClient
+    }
+    return &Client{baseURL: strings.TrimRight(baseURL, "/"), http: hc}, nil
+}
+
+// GetUser fetches a user by SCIM id.
+func (c *Client) GetUser(ctx context.Context, id string) (*User, error) {
+    var u User
+    if err := c.do(ctx, http.MethodGet, "/Users/"+url.PathEscape(id), nil, &u); err != nil {
+        return nil, err
+    }
+    return &u, nil
+}
+
+// FindUser returns the first user matching attr eq value, or nil.
+func (c *Client) FindUser(ctx context.Context, attr, value string) (*User, error) {
+    var list struct {
+        Resources []User `json:"Resources"`
+    }
+    if err := c.do(ctx, http.MethodGet, "/Users?filter="+url.QueryEscape(filterEq(attr, value)), nil, &list); err != nil {
+        return nil, err
+    }
+    if len(list.Resources) == 0 {
+        return nil, nil
+    }
+    return &list.Resources[0], nil
+}
+
+// ListUsers returns the page of users starting at the 1-based startIndex
+// and the total number of users.
+func (c *Client) ListUsers(ctx context.Context, startIndex, count int) ([]User, int, error) {
+    var list struct {
+        TotalResults int    `json:"totalResults"`
+        Resources    []User `json:"Resources"`
+    }
+    path := fmt.Sprintf("/Users?excludedAttributes=groups&startIndex=%d&count=%d", startIndex, count)
+    if err := c.do(ctx, http.MethodGet, path, nil, &list); err != nil {
+        return nil, 0, err
+    }
+    return list.Resources, list.TotalResults, nil
+}
+
+// CreateUser creates a user and returns it with its SCIM id.
+func (c *Client) CreateUser(ctx context.Context, u *User) (*User, error) {
+    u.Schemas = []string{SchemaUser}
+    var out User
+    if err := c.do(ctx, http.MethodPost, "/Users", u, &out); err != nil {
+        return nil, err
+    }
+    return &out, nil
+}
+
+// PatchUser applies PATCH operations to a user.
+func (c *Client) PatchUser(ctx context.Context, id string, ops ...PatchOp) error {
+    return c.patch(ctx, "/Users/"+url.PathEscape(id), ops)
+}
+
+// FindGroup returns the group with the given displayName, or nil.
+func (c *Client) FindGroup(ctx context.Context, displayName string) (*Group, error) {
+    var list struct {
+        Resources []Group `json:"Resources"`
+    }
+    path := "/Groups?excludedAttributes=members&filter=" + url.QueryEscape(filterEq("displayName", displayName))
+    if err := c.do(ctx, http.MethodGet, path, nil, &list); err != nil {
+        return nil, err
+    }
+    if len(list.Resources) == 0 {
+        return nil, nil
+    }
+    return &list.Resources[0], nil
+}
+
+// CreateGroup creates an empty group.
+func (c *Client) CreateGroup(ctx context.Context, displayName string) (*Group, error) {
+    var out Group
+    in := Group{Schemas: []string{SchemaGroup}, DisplayName: displayName}
+    if err := c.do(ctx, http.MethodPost, "/Groups", in, &out); err != nil {
+        return nil, err
+    }
+    return &out, nil
+}
+
+// AddMember adds a user to a group.
+func (c *Client) AddMember(ctx context.Context, groupID, userID string) error {
+    return c.patch(ctx, "/Groups/"+url.PathEscape(groupID), []PatchOp{
+        {Op: "add", Path: "members", Value: []MultiValue{{Value: userID}}},
+    })
+}
+
+// RemoveMember removes a user from a group.
+func (c *Client) RemoveMember(ctx context.Context, groupID, userID string) error {
+    return c.patch(ctx, "/Groups/"+url.PathEscape(groupID), []PatchOp{
+        {Op: "remove", Path: fmt.Sprintf("members[value eq %q]", userID)},
+    })
+}
+
+func (c *Client) patch(ctx context.Context, path string, ops []PatchOp) error {
+    body := struct {
+        Schemas    []string  `json:"schemas"`
+        Operations []PatchOp `json:"Operations"`
+    }{[]string{SchemaPatchOp}, ops}
+    return c.do(ctx, http.MethodPatch, path, body, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+    var body io.Reader
+    if in != nil {
+        b, err := json.Marshal(in)
+        if err != nil {
+            return err
+        }
+        body = bytes.NewReader(b)
+    }
+    req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Accept", contentTypeSCIM+", application/json")
+    if in != nil {
+        req.Header.Set("Content-Type", contentTypeSCIM)
+    }
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return fmt.Errorf("scim %s %s: %w", method, path, err)
+    }
+    defer resp.Body.Close()
+    data, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        se := &Error{Status: resp.StatusCode}
+        var e struct {
+            ScimType string `json:"scimType"`
+            Detail   string `json:"detail"`
+        }
+        if json.Unmarshal(data, &e) == nil {
+            se.ScimType, se.Detail = e.ScimType, e.Detail
+        }
+        if se.Detail == "" {
+            se.Detail = http.StatusText(resp.StatusCode)
+        }
+        return se
+    }
+    if out != nil && len(data) > 0 {
+        if err := json.Unmarshal(data, out); err != nil {
+            return fmt.Errorf("scim %s %s: decode response: %w", method, path, err)
+        }
+    }
+    return nil
+}
+
+// filterEq builds a SCIM filter `attr eq "value"` with value quoted as a
+// JSON string.
+func filterEq(attr, value string) string {
+    q, _ := json.Marshal(value)
+    return attr + " eq " + string(q)
+}
@@ -0,0 +1,143 @@
+package scim
+
+import (
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    SchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+    SchemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+    SchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+// serviceProviderConfig describes what this server supports (RFC 7643 §5).
+func serviceProviderConfig(c *gin.Context) {
+    writeSCIM(c, http.StatusOK, gin.H{
+        "schemas":        []string{SchemaServiceProviderConfig},
+        "patch":          gin.H{"supported": true},
+        "bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+        "filter":         gin.H{"supported": true, "maxResults": maxPageSize},
+        "changePassword": gin.H{"supported": false},
+        "sort":           gin.H{"supported": false},
+        "etag":           gin.H{"supported": true},
+        "authenticationSchemes": []gin.H{{
+            "type":        "oauthbearertoken",
+            "name":        "OAuth Bearer Token",
+            "description": "Client-credentials access token with the SCIM scope",
+            "primary":     true,
+        }},
+        "meta": gin.H{"resourceType": "ServiceProviderConfig", "location": location(c, "ServiceProviderConfig", "")},
+    })
+}
+
+var resourceTypeDocs = map[string]gin.H{
+    "User": {
+        "schemas":     []string{SchemaResourceType},
+        "id":          "User",
+        "name":        "User",
+        "endpoint":    "/Users",
+        "description": "Staff of the tenant organization",
+        "schema":      SchemaUser,
+    },
+    "Group": {
+        "schemas":     []string{SchemaResourceType},
+        "id":          "Group",
+        "name":        "Group",
+        "endpoint":    "/Groups",
+        "description": "Member roles of the tenant organization",
+        "schema":      SchemaGroup,
+    },
+}
+
+// resourceTypes lists the resource types, or returns one for /ResourceTypes/:id.
+func resourceTypes(c *gin.Context) {
+    if id := c.Param("id"); id != "" {
+        doc, ok := resourceTypeDocs[id]
+        if !ok {
+            writeError(c, http.StatusNotFound, "", "resource type not found")
+            return
+        }
+        writeSCIM(c, http.StatusOK, doc)
+        return
+    }
+    items := []gin.H{resourceTypeDocs["User"], resourceTypeDocs["Group"]}
+    writeList(c, items, int64(len(items)), 1)
+}
+
+func attribute(name, typ string, multi, required bool, mutability, uniqueness string, sub ...gin.H) gin.H {
+    a := gin.H{
+        "name":        name,
+        "type":        typ,
+        "multiValued": multi,
+        "required":    required,
+        "caseExact":   false,
+        "mutability":  mutability,
+        "returned":    "default",
+        "uniqueness":  uniqueness,
+    }
+    if len(sub) > 0 {
+        a["subAttributes"] = sub
+    }
+    return a
+}
+
+var schemaDocs = map[string]gin.H{
+    SchemaUser: {
+        "schemas":     []string{SchemaSchema},
+        "id":          SchemaUser,
+        "name":        "User",
+        "description": "User account",
+        "attributes": []gin.H{
+            attribute("userName", "string", false, true, "readWrite", "server"),
+            attribute("externalId", "string", false, false, "readWrite", "none"),
+            attribute("name", "complex", false, false, "readWrite", "none",
+                attribute("givenName", "string", false, false, "readWrite", "none"),
+                attribute("familyName", "string", false, false, "readWrite", "none"),
+            ),
+            attribute("emails", "complex", true, false, "readWrite", "none",
+                attribute("value", "string", false, false, "readWrite", "none"),
+                attribute("type", "string", false, false, "readWrite", "none"),
+                attribute("primary", "boolean", false, false, "readWrite", "none"),
+            ),
+            attribute("phoneNumbers", "complex", true, false, "readWrite", "none",
+                attribute("value", "string", false, false, "readWrite", "none"),
+                attribute("type", "string", false, false, "readWrite", "none"),
+            ),
+            attribute("active", "boolean", false, false, "readWrite", "none"),
+            attribute("groups", "complex", true, false, "readOnly", "none",
+                attribute("value", "string", false, false, "readOnly", "none"),
+                attribute("display", "string", false, false, "readOnly", "none"),
+            ),
+        },
+    },
+    SchemaGroup: {
+        "schemas":     []string{SchemaSchema},
+        "id":          SchemaGroup,
+        "name":        "Group",
+        "description": "Member role within the tenant organization",
+        "attributes": []gin.H{
+            attribute("displayName", "string", false, true, "readWrite", "server"),
+            attribute("members", "complex", true, false, "readWrite", "none",
+                attribute("value", "string", false, false, "immutable", "none"),
+                attribute("display", "string", false, false, "readOnly", "none"),
+            ),
+        },
+    },
+}
+
+// schemas lists the supported schemas, or returns one for /Schemas/:id.
+func schemas(c *gin.Context) {
+    if id := c.Param("id"); id != "" {
+        doc, ok := schemaDocs[id]
+        if !ok {
+            writeError(c, http.StatusNotFound, "", "schema not found")
+            return
+        }
+        writeSCIM(c, http.StatusOK, doc)
+        return
+    }
+    items := []gin.H{schemaDocs[SchemaUser], schemaDocs[SchemaGroup]}
+    writeList(c, items, int64(len(items)), 1)
+}
@@ -0,0 +1,4 @@
+package scim
+
+// Push exposes the outbox's push of one change for tests.
+var Push = (*Outbox).push
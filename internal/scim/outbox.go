@@ -0,0 +1,390 @@
+package scim
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+
+    "smart-transit-system/internal/models"
+)
+
+// OutboxConfig configures the SCIM push worker.
+type OutboxConfig struct {
+    GroupPrefix string // org role groups are named <prefix>_<org id>_<role>; defaults to "transit"
+    MaxAttempts int    // attempts before a change is parked with failed_at; defaults to 10
+    BatchSize   int    // changes pushed per poll; defaults to 50
+    // Lease is how long a claimed change is hidden from other workers while
+    // it is pushed; a worker that dies mid-push releases it when the lease
+    // runs out. Defaults to 5m and must exceed the SCIM calls of one change.
+    Lease time.Duration
+}
+
+// Outbox records local user and membership changes in scim_outbox and
+// pushes them to the IdP. Changes of one user are applied in order; a
+// change waits until every earlier change of the same user is done or
+// parked. A nil *Outbox accepts and drops changes, so handlers need not
+// check whether SCIM is enabled.
+type Outbox struct {
+    db     *gorm.DB
+    client *Client
+    cfg    OutboxConfig
+
+    mu     sync.Mutex
+    groups map[string]string // display name -> SCIM group id
+}
+
+// NewOutbox returns an outbox pushing through client.
+func NewOutbox(db *gorm.DB, client *Client, cfg OutboxConfig) *Outbox {
+    if cfg.GroupPrefix == "" {
+        cfg.GroupPrefix = "transit"
+    }
+    if cfg.MaxAttempts <= 0 {
+        cfg.MaxAttempts = 10
+    }
+    if cfg.BatchSize <= 0 {
+        cfg.BatchSize = 50
+    }
+    if cfg.Lease <= 0 {
+        cfg.Lease = 5 * time.Minute
+    }
+    return &Outbox{db: db, client: client, cfg: cfg, groups: map[string]string{}}
+}
+
+// UserSync pushes the user's current profile and status.
+func UserSync(userID string) models.ScimOutbox {
+    return models.ScimOutbox{Op: models.ScimOpUserSync, UserID: userID}
+}
+
+// GroupAdd adds the user to the group for role in org.
+func GroupAdd(userID, orgID, role string) models.ScimOutbox {
+    return models.ScimOutbox{Op: models.ScimOpGroupAdd, UserID: userID, OrgID: orgID, Role: role}
+}
+
+// GroupRemove removes the user from the group for role in org.
+func GroupRemove(userID, orgID, role string) models.ScimOutbox {
+    return models.ScimOutbox{Op: models.ScimOpGroupRemove, UserID: userID, OrgID: orgID, Role: role}
+}
+
+// Enqueue stores changes using tx, which should be the transaction that
+// made the local change so both commit or roll back together.
+func (o *Outbox) Enqueue(tx *gorm.DB, changes ...models.ScimOutbox) error {
+    if o == nil || len(changes) == 0 {
+        return nil
+    }
+    now := time.Now()
+    for i := range changes {
+        changes[i].NextAttemptAt = now
+    }
+    return tx.Create(&changes).Error
+}
+
+// GroupName returns the IdP group name used for an org role.
+func (o *Outbox) GroupName(orgID, role string) string {
+    return fmt.Sprintf("%s_%s_%s", o.cfg.GroupPrefix, orgID, role)
+}
+
+// Run pushes due changes every interval until ctx is done.
+func (o *Outbox) Run(ctx context.Context, interval time.Duration) {
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        if _, err := o.Drain(ctx); err != nil && ctx.Err() == nil {
+            log.Printf("WARN: scim outbox: %v", err)
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+    }
+}
+
+// Drain pushes up to BatchSize due changes and returns how many it handled.
+func (o *Outbox) Drain(ctx context.Context) (int, error) {
+    n := 0
+    for n < o.cfg.BatchSize {
+        handled, err := o.processNext(ctx)
+        if err != nil || !handled {
+            return n, err
+        }
+        n++
+    }
+    return n, nil
+}
+
+// processNext claims the oldest due change, pushes it, and deletes or
+// reschedules it. No transaction or row lock is held during the SCIM calls:
+// the claim sets locked_until and commits, and the result is recorded
+// afterwards only if the claim is still ours.
+func (o *Outbox) processNext(ctx context.Context) (bool, error) {
+    row, err := o.claimNext(ctx)
+    if err != nil || row == nil {
+        return false, err
+    }
+    lease := *row.LockedUntil
+    applyErr := o.apply(ctx, o.db.WithContext(ctx), row)
+
+    // Guarded on the lease: if it ran out and another worker claimed the
+    // change, that worker records the outcome instead.
+    owned := o.db.WithContext(ctx).Model(&models.ScimOutbox{}).Where("id = ? AND locked_until = ?", row.ID, lease)
+    var res *gorm.DB
+    if applyErr == nil {
+        res = owned.Delete(&models.ScimOutbox{})
+    } else {
+        row.Attempts++
+        row.LastError = applyErr.Error()
+        if !retryable(applyErr) || row.Attempts >= o.cfg.MaxAttempts {
+            now := time.Now()
+            row.FailedAt = &now
+            log.Printf("WARN: scim: %s for user %s parked after %d attempts: %v", row.Op, row.UserID, row.Attempts, applyErr)
+        } else {
+            row.NextAttemptAt = time.Now().Add(backoff(row.Attempts))
+            log.Printf("WARN: scim: %s for user %s failed (attempt %d), retrying: %v", row.Op, row.UserID, row.Attempts, applyErr)
+        }
+        res = owned.Updates(map[string]any{
+            "attempts":        row.Attempts,
+            "last_error":      row.LastError,
+            "failed_at":       row.FailedAt,
+            "next_attempt_at": row.NextAttemptAt,
+            "locked_until":    nil,
+        })
+    }
+    if res.Error != nil {
+        return true, res.Error
+    }
+    if res.RowsAffected == 0 {
+        log.Printf("WARN: scim: lease on %s for user %s expired during the push; outcome not recorded", row.Op, row.UserID)
+    }
+    return true, nil
+}
+
+// claimNext locks the oldest due, unclaimed change (skipping rows other
+// replicas are claiming right now), leases it and commits. A change waits
+// while an earlier change of the same user is pending or claimed.
+func (o *Outbox) claimNext(ctx context.Context) (*models.ScimOutbox, error) {
+    var claimed *models.ScimOutbox
+    err := o.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+        now := time.Now()
+        var rows []models.ScimOutbox
+        err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+            Where("failed_at IS NULL AND next_attempt_at <= ?", now).
+            Where("locked_until IS NULL OR locked_until <= ?", now).
+            Where("NOT EXISTS (SELECT 1 FROM scim_outbox AS p WHERE p.user_id = scim_outbox.user_id AND p.failed_at IS NULL AND p.id < scim_outbox.id)").
+            Order("id").Limit(1).Find(&rows).Error
+        if err != nil || len(rows) == 0 {
+            return err
+        }
+        // Postgres keeps microseconds; truncate so the lease compares equal later.
+        lease := now.Add(o.cfg.Lease).Truncate(time.Microsecond)
+        if err := tx.Model(&rows[0]).UpdateColumn("locked_until", lease).Error; err != nil {
+            return err
+        }
+        rows[0].LockedUntil = &lease
+        claimed = &rows[0]
+        return nil
+    })
+    return claimed, err
+}
+
+// apply pushes one change. db is not a transaction: the SCIM calls run
+// without holding database locks.
+func (o *Outbox) apply(ctx context.Context, db *gorm.DB, row *models.ScimOutbox) error {
+    var user models.User
+    err := db.First(&user, "id = ?", row.UserID).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil // user deleted locally; nothing left to push
+    }
+    if err != nil {
+        return err
+    }
+    return o.push(ctx, db, &user, row)
+}
+
+// push sends one change for user to the IdP.
+func (o *Outbox) push(ctx context.Context, db *gorm.DB, user *models.User, row *models.ScimOutbox) error {
+    scimID, err := o.ResolveUser(ctx, db, user)
+    if err != nil {
+        return err
+    }
+    switch row.Op {
+    case models.ScimOpUserSync:
+        err = o.client.PatchUser(ctx, scimID, syncOps(user)...)
+        if IsNotFound(err) {
+            // Stale id (user recreated at the IdP): resolve again once.
+            user.ScimID = ""
+            if scimID, err = o.ResolveUser(ctx, db, user); err != nil {
+                return err
+            }
+            err = o.client.PatchUser(ctx, scimID, syncOps(user)...)
+        }
+        return err
+    case models.ScimOpGroupAdd:
+        gid, err := o.groupID(ctx, o.GroupName(row.OrgID, row.Role), true)
+        if err != nil {
+            return err
+        }
+        return o.client.AddMember(ctx, gid, scimID)
+    case models.ScimOpGroupRemove:
+        gid, err := o.groupID(ctx, o.GroupName(row.OrgID, row.Role), false)
+        if err != nil || gid == "" {
+            return err
+        }
+        if err := o.client.RemoveMember(ctx, gid, scimID); err != nil && !IsNotFound(err) {
+            return err
+        }
+        return nil
+    }
+    return &Error{Status: http.StatusBadRequest, Detail: "unknown outbox op " + row.Op}
+}
+
+// ResolveUser returns the user's SCIM id, looking it up (or creating the
+// user) when it is not stored yet, and saves it on the local row. Asgardeo
+// uses the SCIM id as the token sub, so for its own users that is tried
+// first, then the userName (their email, which provisioning only stores when
+// verified). Users of other issuers never link to an existing IdP account by
+// email: they get their own IdP user, found again by its externalId.
+func (o *Outbox) ResolveUser(ctx context.Context, db *gorm.DB, user *models.User) (string, error) {
+    if user.ScimID != "" {
+        return user.ScimID, nil
+    }
+    var id string
+    var u *User
+    var err error
+    if user.Issuer == "" {
+        u, err = o.client.GetUser(ctx, user.Sub)
+        switch {
+        case err == nil:
+            id = u.ID
+        case !IsNotFound(err):
+            return "", err
+        }
+        if id == "" && user.Email != "" {
+            if u, err = o.client.FindUser(ctx, "userName", user.Email); err != nil {
+                return "", err
+            }
+            if u != nil {
+                id = u.ID
+            }
+        }
+    } else {
+        if u, err = o.client.FindUser(ctx, "externalId", user.ID); err != nil {
+            return "", err
+        }
+        if u != nil {
+            id = u.ID
+        }
+    }
+    if id == "" {
+        u, err = o.client.CreateUser(ctx, newUser(user))
+        if IsConflict(err) && user.Issuer == "" && user.Email != "" {
+            u, err = o.client.FindUser(ctx, "userName", user.Email)
+        }
+        if err != nil {
+            return "", err
+        }
+        if u == nil || u.ID == "" {
+            return "", errors.New("scim: created user has no id")
+        }
+        id = u.ID
+    }
+    // UpdateColumn keeps updated_at (and so the /me ETag) unchanged.
+    if err := db.Model(user).UpdateColumn("scim_id", id).Error; err != nil {
+        return "", err
+    }
+    user.ScimID = id
+    return id, nil
+}
+
+// groupID finds (and with create, creates) the group with the given name.
+// It returns "" when the group does not exist and create is false.
+func (o *Outbox) groupID(ctx context.Context, name string, create bool) (string, error) {
+    o.mu.Lock()
+    id, ok := o.groups[name]
+    o.mu.Unlock()
+    if ok {
+        return id, nil
+    }
+    g, err := o.client.FindGroup(ctx, name)
+    if err != nil {
+        return "", err
+    }
+    if g == nil {
+        if !create {
+            return "", nil
+        }
+        if g, err = o.client.CreateGroup(ctx, name); err != nil {
+            return "", err
+        }
+    }
+    o.mu.Lock()
+    o.groups[name] = g.ID
+    o.mu.Unlock()
+    return g.ID, nil
+}
+
+// newUser builds the IdP user for u. Users of other issuers are named by
+// their local id and carry no email, so they cannot collide with (or be
+// mistaken for) an Asgardeo account that owns the address.
+func newUser(u *models.User) *User {
+    out := &User{ExternalID: u.ID, UserName: u.Email}
+    if u.Issuer != "" {
+        out.UserName = u.ID
+    } else if out.UserName == "" {
+        out.UserName = u.Sub
+    }
+    if u.FirstName != "" || u.LastName != "" {
+        out.Name = &Name{GivenName: u.FirstName, FamilyName: u.LastName}
+    }
+    if u.Email != "" && u.Issuer == "" {
+        out.Emails = []MultiValue{{Value: u.Email, Primary: true}}
+    }
+    if u.Phone != "" {
+        out.PhoneNumbers = []MultiValue{{Value: u.Phone, Type: "mobile"}}
+    }
+    active := u.Status == "" || u.Status == models.UserStatusActive
+    out.Active = &active
+    return out
+}
+
+// syncOps replaces the attributes this service owns: name, mobile number
+// and active. Email and userName stay owned by the IdP.
+func syncOps(u *models.User) []PatchOp {
+    value := map[string]any{
+        "name":   map[string]string{"givenName": u.FirstName, "familyName": u.LastName},
+        "active": u.Status == "" || u.Status == models.UserStatusActive,
+    }
+    if u.Phone != "" {
+        value["phoneNumbers"] = []MultiValue{{Value: u.Phone, Type: "mobile"}}
+    }
+    return []PatchOp{{Op: "replace", Value: value}}
+}
+
+// retryable reports whether a failed push should be retried: transport and
+// token errors, throttling, server errors, and 401/403 (usually a missing
+// scope that an operator can fix).
+func retryable(err error) bool {
+    var se *Error
+    if !errors.As(err, &se) {
+        return true
+    }
+    return se.Temporary() || se.Status == http.StatusUnauthorized || se.Status == http.StatusForbidden
+}
+
+// backoff doubles from 30s per attempt, capped at one hour.
+func backoff(attempts int) time.Duration {
+    d := 30 * time.Second
+    for i := 1; i < attempts && d < time.Hour; i++ {
+        d *= 2
+    }
+    if d > time.Hour {
+        d = time.Hour
+    }
+    return d
+}
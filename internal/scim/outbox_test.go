@@ -0,0 +1,342 @@
+package scim_test
+
+import (
+    "context"
+    "errors"
+    "net/http/httptest"
+    "os"
+    "testing"
+    "time"
+
+    "gorm.io/driver/postgres"
+    "gorm.io/gorm"
+    "gorm.io/gorm/logger"
+
+    "smart-transit-system/internal/models"
+    "smart-transit-system/internal/scim"
+    "smart-transit-system/internal/scim/scimtest"
+)
+
+// testDB connects to TEST_DATABASE_URL, a throwaway Postgres database: the
+// users and scim_outbox tables are emptied before each test.
+func testDB(t *testing.T) *gorm.DB {
+    t.Helper()
+    dsn := os.Getenv("TEST_DATABASE_URL")
+    if dsn == "" {
+        t.Skip("TEST_DATABASE_URL not set")
+    }
+    db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := db.AutoMigrate(&models.User{}, &models.ScimOutbox{}); err != nil {
+        t.Fatal(err)
+    }
+    if err := db.Exec("TRUNCATE scim_outbox, users CASCADE").Error; err != nil {
+        t.Fatal(err)
+    }
+    return db
+}
+
+// dryRunDB returns a session that builds SQL without a database, for tests
+// of the SCIM side of the outbox: writes succeed and reads find nothing.
+func dryRunDB(t *testing.T) *gorm.DB {
+    t.Helper()
+    db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true, Logger: logger.Default.LogMode(logger.Silent)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return db
+}
+
+func newTestOutbox(t *testing.T, db *gorm.DB, cfg scim.OutboxConfig) (*scim.Outbox, *scimtest.Stub) {
+    t.Helper()
+    stub := scimtest.NewStub()
+    srv := httptest.NewServer(stub)
+    t.Cleanup(srv.Close)
+    client, err := scim.NewClient(srv.URL+"/scim2", srv.Client())
+    if err != nil {
+        t.Fatal(err)
+    }
+    return scim.NewOutbox(db, client, cfg), stub
+}
+
+// seedUser creates a local user whose sub is also its id at the stub, as
+// for users who signed in through Asgardeo.
+func seedUser(t *testing.T, db *gorm.DB, stub *scimtest.Stub, email string) models.User {
+    t.Helper()
+    sub := stub.AddUser(scim.User{UserName: email})
+    u := models.User{Sub: sub, Email: email, FirstName: "Old", Status: models.UserStatusActive}
+    if err := db.Create(&u).Error; err != nil {
+        t.Fatal(err)
+    }
+    return u
+}
+
+func enqueue(t *testing.T, db *gorm.DB, o *scim.Outbox, change models.ScimOutbox) models.ScimOutbox {
+    t.Helper()
+    changes := []models.ScimOutbox{change}
+    if err := o.Enqueue(db, changes...); err != nil {
+        t.Fatal(err)
+    }
+    // Enqueue sets the id on its own copy; read the row back.
+    var row models.ScimOutbox
+    if err := db.Order("id DESC").First(&row).Error; err != nil {
+        t.Fatal(err)
+    }
+    return row
+}
+
+func drain(t *testing.T, o *scim.Outbox) int {
+    t.Helper()
+    n, err := o.Drain(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    return n
+}
+
+func reload(t *testing.T, db *gorm.DB, id int64) (models.ScimOutbox, bool) {
+    t.Helper()
+    var row models.ScimOutbox
+    err := db.First(&row, "id = ?", id).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return row, false
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    return row, true
+}
+
+// makeDue moves a rescheduled change's next attempt into the past.
+func makeDue(t *testing.T, db *gorm.DB, id int64) {
+    t.Helper()
+    if err := db.Model(&models.ScimOutbox{}).Where("id = ?", id).UpdateColumn("next_attempt_at", time.Now().Add(-time.Second)).Error; err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestOutboxPerUserOrderAndBackoff(t *testing.T) {
+    db := testDB(t)
+    o, stub := newTestOutbox(t, db, scim.OutboxConfig{})
+    alice := seedUser(t, db, stub, "alice@example.com")
+    bob := seedUser(t, db, stub, "bob@example.com")
+
+    first := enqueue(t, db, o, scim.GroupAdd(alice.ID, "org-1", "manager"))
+    second := enqueue(t, db, o, scim.UserSync(alice.ID))
+    other := enqueue(t, db, o, scim.UserSync(bob.ID))
+
+    // Alice's first change fails; her second must wait, Bob's goes ahead.
+    stub.FailNext = 1
+    before := time.Now()
+    if n := drain(t, o); n != 2 {
+        t.Fatalf("drained %d changes, want 2", n)
+    }
+    row, ok := reload(t, db, first.ID)
+    if !ok || row.Attempts != 1 || row.LastError == "" || row.FailedAt != nil {
+        t.Fatalf("first change after failure: %+v (present %v)", row, ok)
+    }
+    if wait := row.NextAttemptAt.Sub(before); wait < 29*time.Second || wait > 31*time.Second {
+        t.Errorf("first retry in %v, want 30s", wait)
+    }
+    if row.LockedUntil != nil {
+        t.Errorf("failed change still claimed until %v", row.LockedUntil)
+    }
+    if row, ok := reload(t, db, second.ID); !ok || row.Attempts != 0 {
+        t.Fatalf("second change ran before the first: %+v (present %v)", row, ok)
+    }
+    if _, ok := reload(t, db, other.ID); ok {
+        t.Error("another user's change was held back")
+    }
+
+    makeDue(t, db, first.ID)
+    if n := drain(t, o); n != 2 {
+        t.Fatalf("drained %d changes, want 2", n)
+    }
+    if members := stub.Members(o.GroupName("org-1", "manager")); len(members) != 1 || members[0] != alice.Sub {
+        t.Errorf("group members = %v, want [%s]", members, alice.Sub)
+    }
+    if u, _ := stub.User(alice.Sub); u.Name == nil || u.Name.GivenName != "Old" {
+        t.Errorf("user sync not pushed: %+v", u)
+    }
+    var left int64
+    db.Model(&models.ScimOutbox{}).Count(&left)
+    if left != 0 {
+        t.Errorf("%d changes left in the outbox", left)
+    }
+}
+
+func TestOutboxRecreatesUserOn404(t *testing.T) {
+    db := testDB(t)
+    o, stub := newTestOutbox(t, db, scim.OutboxConfig{})
+    u := models.User{Sub: "deleted-at-idp", Email: "carol@example.com", FirstName: "Carol", ScimID: "stale-id", Status: models.UserStatusActive}
+    if err := db.Create(&u).Error; err != nil {
+        t.Fatal(err)
+    }
+    enqueue(t, db, o, scim.UserSync(u.ID))
+
+    if n := drain(t, o); n != 1 {
+        t.Fatalf("drained %d changes, want 1", n)
+    }
+    var got models.User
+    if err := db.First(&got, "id = ?", u.ID).Error; err != nil {
+        t.Fatal(err)
+    }
+    if got.ScimID == "" || got.ScimID == "stale-id" {
+        t.Fatalf("scim_id = %q, want the recreated user's id", got.ScimID)
+    }
+    created, ok := stub.User(got.ScimID)
+    if !ok || created.UserName != "carol@example.com" || created.ExternalID != u.ID {
+        t.Errorf("recreated user = %+v (found %v)", created, ok)
+    }
+}
+
+func TestOutboxParksFailedChanges(t *testing.T) {
+    db := testDB(t)
+    o, stub := newTestOutbox(t, db, scim.OutboxConfig{MaxAttempts: 2})
+    dave := seedUser(t, db, stub, "dave@example.com")
+
+    // Retryable failures are parked after MaxAttempts.
+    retried := enqueue(t, db, o, scim.UserSync(dave.ID))
+    later := enqueue(t, db, o, scim.GroupAdd(dave.ID, "org-1", "admin"))
+    stub.FailNext = 2
+    drain(t, o)
+    makeDue(t, db, retried.ID)
+    drain(t, o)
+    row, ok := reload(t, db, retried.ID)
+    if !ok || row.FailedAt == nil || row.Attempts != 2 {
+        t.Fatalf("change after %d failures: %+v (present %v)", 2, row, ok)
+    }
+    // A parked change no longer holds back the user's later changes.
+    if _, ok := reload(t, db, later.ID); ok {
+        t.Error("later change is still waiting behind a parked one")
+    }
+
+    // Client errors other than 401/403 are parked at once.
+    ghost := models.User{Sub: "ghost", ScimID: "not-at-idp", Status: models.UserStatusActive}
+    if err := db.Create(&ghost).Error; err != nil {
+        t.Fatal(err)
+    }
+    rejected := enqueue(t, db, o, scim.GroupAdd(ghost.ID, "org-1", "admin"))
+    drain(t, o)
+    if row, ok := reload(t, db, rejected.ID); !ok || row.FailedAt == nil || row.Attempts != 1 {
+        t.Fatalf("rejected change: %+v (present %v)", row, ok)
+    }
+    if n := drain(t, o); n != 0 {
+        t.Errorf("parked changes were retried (%d)", n)
+    }
+}
+
+func TestOutboxSkipsClaimedChanges(t *testing.T) {
+    db := testDB(t)
+    o, stub := newTestOutbox(t, db, scim.OutboxConfig{})
+    erin := seedUser(t, db, stub, "erin@example.com")
+    row := enqueue(t, db, o, scim.UserSync(erin.ID))
+
+    // Another worker holds the claim: leave the change alone.
+    lease := time.Now().Add(time.Minute)
+    db.Model(&models.ScimOutbox{}).Where("id = ?", row.ID).UpdateColumn("locked_until", lease)
+    if n := drain(t, o); n != 0 {
+        t.Fatalf("drained %d claimed changes", n)
+    }
+    // Once its lease ran out, the change is picked up again.
+    db.Model(&models.ScimOutbox{}).Where("id = ?", row.ID).UpdateColumn("locked_until", time.Now().Add(-time.Second))
+    if n := drain(t, o); n != 1 {
+        t.Fatalf("drained %d changes after the lease expired, want 1", n)
+    }
+    if _, ok := reload(t, db, row.ID); ok {
+        t.Error("change was not deleted after a successful push")
+    }
+}
+
+func TestResolveUserKeepsOtherIssuersApart(t *testing.T) {
+    db := dryRunDB(t)
+    o, stub := newTestOutbox(t, db, scim.OutboxConfig{})
+    victim := stub.AddUser(scim.User{UserName: "victim@example.com", Emails: []scim.MultiValue{{Value: "victim@example.com", Primary: true}}})
+
+    // A Firebase user claiming the victim's address gets an IdP user of
+    // their own, never the victim's account.
+    u := models.User{ID: "local-1", Issuer: "https://securetoken.google.com/legacy", Sub: "fb-1", Email: "victim@example.com", Status: models.UserStatusActive}
+    id, err := o.ResolveUser(context.Background(), db, &u)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if id == victim {
+        t.Fatal("linked to the IdP user owning the email")
+    }
+    created, ok := stub.User(id)
+    if !ok || created.ExternalID != u.ID || created.UserName != u.ID || len(created.Emails) != 0 {
+        t.Errorf("created user = %+v (found %v)", created, ok)
+    }
+
+    // Resolving again (scim_id lost) finds the same user by externalId.
+    u.ScimID = ""
+    again, err := o.ResolveUser(context.Background(), db, &u)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if again != id {
+        t.Errorf("resolved %s, then %s", id, again)
+    }
+}
+
+func TestResolveUserLinksPrimaryUsersByEmail(t *testing.T) {
+    db := dryRunDB(t)
+    o, stub := newTestOutbox(t, db, scim.OutboxConfig{})
+    existing := stub.AddUser(scim.User{UserName: "frank@example.com"})
+
+    u := models.User{ID: "local-2", Sub: "not-a-scim-id", Email: "frank@example.com", Status: models.UserStatusActive}
+    id, err := o.ResolveUser(context.Background(), db, &u)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if id != existing || u.ScimID != existing {
+        t.Errorf("resolved %q (scim_id %q), want %s", id, u.ScimID, existing)
+    }
+}
+
+func TestPushWithoutDatabase(t *testing.T) {
+    db := dryRunDB(t)
+    o, stub := newTestOutbox(t, db, scim.OutboxConfig{})
+    ctx := context.Background()
+    sub := stub.AddUser(scim.User{UserName: "gina@example.com"})
+    u := models.User{ID: "local-3", Sub: sub, Email: "gina@example.com", FirstName: "Gina", Phone: "+94770000000", Status: models.UserStatusActive}
+
+    add := scim.GroupAdd(u.ID, "org-1", "admin")
+    if err := scim.Push(o, ctx, db, &u, &add); err != nil {
+        t.Fatal(err)
+    }
+    group := o.GroupName("org-1", "admin")
+    if members := stub.Members(group); len(members) != 1 || members[0] != sub {
+        t.Fatalf("group members = %v, want [%s]", members, sub)
+    }
+
+    sync := scim.UserSync(u.ID)
+    if err := scim.Push(o, ctx, db, &u, &sync); err != nil {
+        t.Fatal(err)
+    }
+    if got, _ := stub.User(sub); got.Name == nil || got.Name.GivenName != "Gina" || len(got.PhoneNumbers) != 1 {
+        t.Errorf("user sync not pushed: %+v", got)
+    }
+
+    remove := scim.GroupRemove(u.ID, "org-1", "admin")
+    if err := scim.Push(o, ctx, db, &u, &remove); err != nil {
+        t.Fatal(err)
+    }
+    if members := stub.Members(group); len(members) != 0 {
+        t.Errorf("group members after removal = %v", members)
+    }
+
+    // The user was deleted at the IdP: the sync recreates it.
+    stub.RemoveUser(sub)
+    if err := scim.Push(o, ctx, db, &u, &sync); err != nil {
+        t.Fatal(err)
+    }
+    if u.ScimID == sub {
+        t.Fatal("scim_id still points at the deleted user")
+    }
+    if got, ok := stub.User(u.ScimID); !ok || got.ExternalID != u.ID {
+        t.Errorf("recreated user = %+v (found %v)", got, ok)
+    }
+}
@@ -0,0 +1,394 @@
+package scim
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+
+    "smart-transit-system/internal/audit"
+    "smart-transit-system/internal/auth"
+    "smart-transit-system/internal/models"
+)
+
+// reconcileLock names the Postgres advisory lock held while a replica
+// reconciles; the others skip their turn.
+const reconcileLock = "smart-transit:idp-reconcile"
+
+// ReconcileConfig configures the periodic pull of the IdP's user list.
+type ReconcileConfig struct {
+    PageSize int // users per list request; defaults to 100
+}
+
+// ReconcileRun summarizes one reconciliation pass.
+type ReconcileRun struct {
+    StartedAt  time.Time `json:"started_at"`
+    FinishedAt time.Time `json:"finished_at"`
+    Upstream   int       `json:"upstream_users"` // users listed by the IdP
+    Matched    int       `json:"matched"`        // listed users known locally
+    Updated    int       `json:"updated"`
+    Skipped    int       `json:"skipped"`  // pending outbox changes or concurrent local edits
+    Missing    int       `json:"missing"`  // newly flagged as missing upstream
+    Restored   int       `json:"restored"` // listed again after being flagged
+    Error      string    `json:"error,omitempty"`
+}
+
+// ReconcileStatus is the reconciler state reported on /ready.
+type ReconcileStatus struct {
+    Running         bool          `json:"running"`
+    LastAttemptAt   *time.Time    `json:"last_attempt_at,omitempty"`
+    LockedElsewhere bool          `json:"locked_elsewhere"`   // another replica was running at the last attempt
+    LastRun         *ReconcileRun `json:"last_run,omitempty"` // last pass run by this replica
+}
+
+// Reconciler pages through the IdP's user list and brings the local users
+// table in line: email, names, mobile number and active/inactive status
+// follow the IdP, and users linked to the IdP that it no longer lists are
+// flagged with missing_upstream_at. Every change is audited. Users with
+// changes still waiting in the outbox are skipped, since the IdP has not
+// seen those yet. A Postgres advisory lock keeps it to one replica at a time.
+type Reconciler struct {
+    db       *gorm.DB
+    client   *Client
+    rev      *auth.Revocations // optional; applies deactivation immediately
+    pageSize int
+
+    mu     sync.Mutex
+    status ReconcileStatus
+}
+
+// NewReconciler returns a reconciler reading users through client. rev may be nil.
+func NewReconciler(db *gorm.DB, client *Client, rev *auth.Revocations, cfg ReconcileConfig) *Reconciler {
+    if cfg.PageSize <= 0 {
+        cfg.PageSize = 100
+    }
+    return &Reconciler{db: db, client: client, rev: rev, pageSize: cfg.PageSize}
+}
+
+// Status returns the current state and the last run's summary.
+func (r *Reconciler) Status() ReconcileStatus {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    st := r.status
+    if st.LastRun != nil {
+        run := *st.LastRun
+        st.LastRun = &run
+    }
+    return st
+}
+
+// Run reconciles every interval until ctx is done.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        if err := r.Reconcile(ctx); err != nil && ctx.Err() == nil {
+            log.Printf("WARN: idp reconcile: %v", err)
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+    }
+}
+
+// Reconcile runs one pass, or returns nil straight away when another
+// replica holds the lock.
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+    now := time.Now()
+    r.mu.Lock()
+    if r.status.Running {
+        r.mu.Unlock()
+        return nil
+    }
+    r.status.Running = true
+    r.status.LastAttemptAt = &now
+    r.mu.Unlock()
+
+    var run *ReconcileRun
+    // Session-level advisory locks belong to a connection, so the lock and
+    // unlock go through one pinned connection; the pass itself uses the pool.
+    err := r.db.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+        var locked bool
+        if err := conn.Raw("SELECT pg_try_advisory_lock(hashtext(?))", reconcileLock).Scan(&locked).Error; err != nil {
+            return fmt.Errorf("advisory lock: %w", err)
+        }
+        if !locked {
+            return nil
+        }
+        defer func() {
+            // Unlock even when ctx is done, or the pooled connection keeps the lock.
+            if err := conn.WithContext(context.Background()).Exec("SELECT pg_advisory_unlock(hashtext(?))", reconcileLock).Error; err != nil {
+                log.Printf("WARN: idp reconcile: advisory unlock: %v", err)
+            }
+        }()
+        run = &ReconcileRun{StartedAt: now}
+        return r.reconcile(ctx, run)
+    })
+
+    r.mu.Lock()
+    r.status.Running = false
+    r.status.LockedElsewhere = run == nil && err == nil
+    if run != nil {
+        run.FinishedAt = time.Now()
+        if err != nil {
+            run.Error = err.Error()
+        }
+        r.status.LastRun = run
+    }
+    r.mu.Unlock()
+
+    if run != nil && run.Updated+run.Missing+run.Restored > 0 {
+        log.Printf("idp reconcile: %d upstream users, %d updated, %d flagged missing, %d restored", run.Upstream, run.Updated, run.Missing, run.Restored)
+    }
+    return err
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, run *ReconcileRun) error {
+    seen := map[string]bool{}
+    for start := 1; ; {
+        users, total, err := r.client.ListUsers(ctx, start, r.pageSize)
+        if err != nil {
+            return fmt.Errorf("list users: %w", err)
+        }
+        for _, u := range users {
+            seen[u.ID] = true
+        }
+        run.Upstream += len(users)
+        if err := r.applyPage(ctx, users, run); err != nil {
+            return err
+        }
+        start += len(users)
+        if len(users) == 0 || start > total {
+            break
+        }
+    }
+    // An empty listing more likely means a wrong SCIM_BASE_URL or a missing
+    // scope than an IdP without users; don't flag everyone.
+    if run.Upstream == 0 {
+        return errors.New("the IdP listed no users; skipping missing-user check")
+    }
+    return r.flagMissing(ctx, seen, run)
+}
+
+// applyPage syncs the local users matching one page of IdP users. Users
+// are matched by stored SCIM id, or by sub (Asgardeo's token sub is the
+// SCIM id) when no id is stored yet. Only users of the primary issuer can
+// match: a sub from another issuer says nothing about Asgardeo's users.
+func (r *Reconciler) applyPage(ctx context.Context, users []User, run *ReconcileRun) error {
+    ids := make([]string, 0, len(users))
+    for _, u := range users {
+        if u.ID != "" {
+            ids = append(ids, u.ID)
+        }
+    }
+    if len(ids) == 0 {
+        return nil
+    }
+    db := r.db.WithContext(ctx)
+    var locals []models.User
+    if err := db.Where("issuer = '' AND (scim_id IN ? OR sub IN ?)", ids, ids).Find(&locals).Error; err != nil {
+        return fmt.Errorf("load local users: %w", err)
+    }
+    if len(locals) == 0 {
+        return nil
+    }
+    byScimID, bySub := map[string]*models.User{}, map[string]*models.User{}
+    localIDs := make([]string, 0, len(locals))
+    for i := range locals {
+        l := &locals[i]
+        localIDs = append(localIDs, l.ID)
+        if l.ScimID != "" {
+            byScimID[l.ScimID] = l
+        } else {
+            bySub[l.Sub] = l
+        }
+    }
+    var pendingIDs []string
+    err := db.Model(&models.ScimOutbox{}).Where("failed_at IS NULL AND user_id IN ?", localIDs).
+        Distinct().Pluck("user_id", &pendingIDs).Error
+    if err != nil {
+        return fmt.Errorf("load pending outbox changes: %w", err)
+    }
+    pending := map[string]bool{}
+    for _, id := range pendingIDs {
+        pending[id] = true
+    }
+    for i := range users {
+        u := &users[i]
+        l, ok := byScimID[u.ID]
+        if !ok {
+            if l, ok = bySub[u.ID]; !ok {
+                continue
+            }
+        }
+        run.Matched++
+        if pending[l.ID] {
+            run.Skipped++
+            continue
+        }
+        if err := r.syncUser(ctx, l, u, run); err != nil {
+            return fmt.Errorf("sync user %s: %w", l.ID, err)
+        }
+    }
+    return nil
+}
+
+// syncUser applies the IdP's view of u to the local row l. The update is
+// guarded on updated_at; a row edited meanwhile is left for the next pass.
+func (r *Reconciler) syncUser(ctx context.Context, l *models.User, u *User, run *ReconcileRun) error {
+    db := r.db.WithContext(ctx)
+    if l.ScimID == "" {
+        // UpdateColumn keeps updated_at (and so the /me ETag) unchanged.
+        if err := db.Model(l).UpdateColumn("scim_id", u.ID).Error; err != nil {
+            return err
+        }
+        l.ScimID = u.ID
+    }
+    current := map[string]string{
+        "email":      l.Email,
+        "first_name": l.FirstName,
+        "last_name":  l.LastName,
+        "phone":      l.Phone,
+        "status":     l.Status,
+    }
+    changes := map[string]any{}
+    diff := map[string]any{}
+    for col, v := range upstreamAttrs(u, l.Status) {
+        if v == current[col] {
+            continue
+        }
+        changes[col] = v
+        diff[col] = map[string]string{"from": current[col], "to": v}
+    }
+    restored := l.MissingUpstreamAt != nil
+    if restored {
+        changes["missing_upstream_at"] = nil
+    }
+    if len(changes) == 0 {
+        return nil
+    }
+    changes["updated_at"] = time.Now()
+    res := db.Model(&models.User{}).Where("id = ? AND updated_at = ?", l.ID, l.UpdatedAt).Updates(changes)
+    if res.Error != nil {
+        return res.Error
+    }
+    if res.RowsAffected == 0 {
+        run.Skipped++
+        return nil
+    }
+    if status, ok := changes["status"].(string); ok && r.rev != nil {
+        r.rev.SetUserStatus(l.Issuer, l.Sub, status)
+    }
+    if len(diff) > 0 {
+        run.Updated++
+        audit.Write(db, l.ID, "", "idp_reconciled", gin.H{"scim_id": u.ID, "changes": diff})
+    }
+    if restored {
+        run.Restored++
+        audit.Write(db, l.ID, "", "idp_restored", gin.H{"scim_id": u.ID, "missing_since": l.MissingUpstreamAt})
+    }
+    return nil
+}
+
+// upstreamAttrs maps an IdP user onto local columns. Absent or empty
+// values never clear local data. Only active and inactive follow the IdP:
+// suspended is decided by admins here and is left alone.
+func upstreamAttrs(u *User, status string) map[string]string {
+    out := map[string]string{}
+    if email := primaryValue(u.Emails, ""); email != "" {
+        out["email"] = email
+    }
+    if u.Name != nil {
+        if u.Name.GivenName != "" {
+            out["first_name"] = u.Name.GivenName
+        }
+        if u.Name.FamilyName != "" {
+            out["last_name"] = u.Name.FamilyName
+        }
+    }
+    if phone := primaryValue(u.PhoneNumbers, "mobile"); phone != "" {
+        out["phone"] = phone
+    }
+    if u.Active != nil {
+        switch {
+        case !*u.Active && (status == "" || status == models.UserStatusActive):
+            out["status"] = models.UserStatusInactive
+        case *u.Active && status == models.UserStatusInactive:
+            out["status"] = models.UserStatusActive
+        }
+    }
+    return out
+}
+
+// primaryValue picks the primary entry, else the first of type typ, else
+// the first entry.
+func primaryValue(values []MultiValue, typ string) string {
+    for _, v := range values {
+        if v.Primary && v.Value != "" {
+            return v.Value
+        }
+    }
+    if typ != "" {
+        for _, v := range values {
+            if v.Type == typ && v.Value != "" {
+                return v.Value
+            }
+        }
+    }
+    for _, v := range values {
+        if v.Value != "" {
+            return v.Value
+        }
+    }
+    return ""
+}
+
+// flagMissing flags local users linked to an IdP id the listing did not
+// include. Each one is confirmed with a lookup first, since users created
+// or deleted while paging shift the pages. Users with pending outbox
+// changes are left out; the outbox recreates users it cannot find.
+func (r *Reconciler) flagMissing(ctx context.Context, seen map[string]bool, run *ReconcileRun) error {
+    db := r.db.WithContext(ctx)
+    var candidates, batch []models.User
+    err := db.Select("id", "scim_id").
+        Where("issuer = '' AND scim_id <> '' AND missing_upstream_at IS NULL").
+        Where("NOT EXISTS (SELECT 1 FROM scim_outbox AS o WHERE o.user_id = users.id AND o.failed_at IS NULL)").
+        FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+            for _, l := range batch {
+                if !seen[l.ScimID] {
+                    candidates = append(candidates, l)
+                }
+            }
+            return nil
+        }).Error
+    if err != nil {
+        return fmt.Errorf("load linked users: %w", err)
+    }
+    for _, l := range candidates {
+        _, err := r.client.GetUser(ctx, l.ScimID)
+        if err == nil {
+            continue // listed late; the next pass syncs it
+        }
+        if !IsNotFound(err) {
+            return fmt.Errorf("look up user %s: %w", l.ScimID, err)
+        }
+        now := time.Now()
+        res := db.Model(&models.User{}).Where("id = ? AND missing_upstream_at IS NULL", l.ID).
+            UpdateColumn("missing_upstream_at", now)
+        if res.Error != nil {
+            return fmt.Errorf("flag user %s: %w", l.ID, res.Error)
+        }
+        if res.RowsAffected > 0 {
+            run.Missing++
+            audit.Write(db, l.ID, "", "idp_missing", gin.H{"scim_id": l.ScimID})
+        }
+    }
+    return nil
+}
@@ -0,0 +1,353 @@
+// Package scimtest provides an in-memory SCIM 2.0 service provider for
+// local development and tests. It implements the subset of /Users and
+// /Groups the scim client uses and does not check authentication.
+package scimtest
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+
+    "smart-transit-system/internal/scim"
+)
+
+// Stub is an in-memory SCIM server. Set FailNext to make the next n
+// requests fail with 503, to exercise retries.
+type Stub struct {
+    mu       sync.Mutex
+    users    map[string]*scim.User
+    groups   map[string]*scim.Group
+    FailNext int
+}
+
+// NewStub returns an empty stub.
+func NewStub() *Stub {
+    return &Stub{users: map[string]*scim.User{}, groups: map[string]*scim.Group{}}
+}
+
+// AddUser seeds a user (e.g. one that logged in through the IdP) and
+// returns its id.
+func (s *Stub) AddUser(u scim.User) string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if u.ID == "" {
+        u.ID = newID()
+    }
+    s.users[u.ID] = &u
+    return u.ID
+}
+
+// User returns a copy of the user with the given id.
+func (s *Stub) User(id string) (scim.User, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    u, ok := s.users[id]
+    if !ok {
+        return scim.User{}, false
+    }
+    return *u, true
+}
+
+// RemoveUser deletes a user, as if it was removed at the IdP.
+func (s *Stub) RemoveUser(id string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.users, id)
+}
+
+// Members returns the member ids of the group with the given name.
+func (s *Stub) Members(displayName string) []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, g := range s.groups {
+        if g.DisplayName == displayName {
+            out := make([]string, 0, len(g.Members))
+            for _, m := range g.Members {
+                out = append(out, m.Value)
+            }
+            return out
+        }
+    }
+    return nil
+}
+
+var filterPattern = regexp.MustCompile(`^(\w+(?:\.\w+)?) eq (".*")$`)
+
+func (s *Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.FailNext > 0 {
+        s.FailNext--
+        writeError(w, http.StatusServiceUnavailable, "", "injected failure")
+        return
+    }
+    path := strings.Trim(r.URL.Path, "/")
+    if i := strings.Index(path, "Users"); i >= 0 {
+        path = path[i:]
+    } else if i := strings.Index(path, "Groups"); i >= 0 {
+        path = path[i:]
+    }
+    resource, id, _ := strings.Cut(path, "/")
+    switch {
+    case resource == "Users" && id == "" && r.Method == http.MethodGet:
+        s.listUsers(w, r)
+    case resource == "Users" && id == "" && r.Method == http.MethodPost:
+        s.createUser(w, r)
+    case resource == "Users" && r.Method == http.MethodGet:
+        if u, ok := s.users[id]; ok {
+            writeJSON(w, http.StatusOK, u)
+            return
+        }
+        writeError(w, http.StatusNotFound, "", "user not found")
+    case resource == "Users" && r.Method == http.MethodPatch:
+        s.patchUser(w, r, id)
+    case resource == "Groups" && id == "" && r.Method == http.MethodGet:
+        s.listGroups(w, r)
+    case resource == "Groups" && id == "" && r.Method == http.MethodPost:
+        s.createGroup(w, r)
+    case resource == "Groups" && r.Method == http.MethodPatch:
+        s.patchGroup(w, r, id)
+    default:
+        writeError(w, http.StatusNotFound, "", "not found")
+    }
+}
+
+func (s *Stub) listUsers(w http.ResponseWriter, r *http.Request) {
+    attr, value, ok := parseFilter(r.URL.Query().Get("filter"))
+    out := []*scim.User{}
+    for _, u := range s.users {
+        if !ok {
+            out = append(out, u)
+            continue
+        }
+        switch attr {
+        case "userName":
+            if strings.EqualFold(u.UserName, value) {
+                out = append(out, u)
+            }
+        case "externalId":
+            if u.ExternalID == value {
+                out = append(out, u)
+            }
+        case "emails", "emails.value":
+            for _, e := range u.Emails {
+                if strings.EqualFold(e.Value, value) {
+                    out = append(out, u)
+                    break
+                }
+            }
+        }
+    }
+    // Pages are taken in id order so listings are stable between requests.
+    sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+    total := len(out)
+    start, _ := strconv.Atoi(r.URL.Query().Get("startIndex"))
+    if start < 1 {
+        start = 1
+    }
+    out = out[min(start-1, total):]
+    if count, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && count >= 0 && count < len(out) {
+        out = out[:count]
+    }
+    writePage(w, out, total, start)
+}
+
+func (s *Stub) createUser(w http.ResponseWriter, r *http.Request) {
+    var u scim.User
+    if err := json.NewDecoder(r.Body).Decode(&u); err != nil || u.UserName == "" {
+        writeError(w, http.StatusBadRequest, "invalidValue", "userName is required")
+        return
+    }
+    for _, other := range s.users {
+        if strings.EqualFold(other.UserName, u.UserName) {
+            writeError(w, http.StatusConflict, "uniqueness", "userName already exists")
+            return
+        }
+    }
+    u.ID = newID()
+    u.Meta = &scim.Meta{ResourceType: "User"}
+    s.users[u.ID] = &u
+    writeJSON(w, http.StatusCreated, &u)
+}
+
+func (s *Stub) patchUser(w http.ResponseWriter, r *http.Request, id string) {
+    u, ok := s.users[id]
+    if !ok {
+        writeError(w, http.StatusNotFound, "", "user not found")
+        return
+    }
+    ops, ok := decodePatch(w, r)
+    if !ok {
+        return
+    }
+    for _, op := range ops {
+        attrs := map[string]json.RawMessage{}
+        if op.Path != "" {
+            attrs[op.Path] = op.Value
+        } else if err := json.Unmarshal(op.Value, &attrs); err != nil {
+            writeError(w, http.StatusBadRequest, "invalidSyntax", "value must be an object")
+            return
+        }
+        // Decoding the changed attributes onto the user covers replace and
+        // add for the single-valued and whole multi-valued attributes used here.
+        b, _ := json.Marshal(attrs)
+        if err := json.Unmarshal(b, u); err != nil {
+            writeError(w, http.StatusBadRequest, "invalidValue", err.Error())
+            return
+        }
+    }
+    writeJSON(w, http.StatusOK, u)
+}
+
+func (s *Stub) listGroups(w http.ResponseWriter, r *http.Request) {
+    attr, value, ok := parseFilter(r.URL.Query().Get("filter"))
+    out := []*scim.Group{}
+    for _, g := range s.groups {
+        if !ok || (attr == "displayName" && g.DisplayName == value) {
+            out = append(out, g)
+        }
+    }
+    writeList(w, out)
+}
+
+func (s *Stub) createGroup(w http.ResponseWriter, r *http.Request) {
+    var g scim.Group
+    if err := json.NewDecoder(r.Body).Decode(&g); err != nil || g.DisplayName == "" {
+        writeError(w, http.StatusBadRequest, "invalidValue", "displayName is required")
+        return
+    }
+    for _, other := range s.groups {
+        if other.DisplayName == g.DisplayName {
+            writeError(w, http.StatusConflict, "uniqueness", "displayName already exists")
+            return
+        }
+    }
+    g.ID = newID()
+    g.Meta = &scim.Meta{ResourceType: "Group"}
+    s.groups[g.ID] = &g
+    writeJSON(w, http.StatusCreated, &g)
+}
+
+var memberPath = regexp.MustCompile(`^members\[value eq "([^"]+)"\]$`)
+
+func (s *Stub) patchGroup(w http.ResponseWriter, r *http.Request, id string) {
+    g, ok := s.groups[id]
+    if !ok {
+        writeError(w, http.StatusNotFound, "", "group not found")
+        return
+    }
+    ops, ok := decodePatch(w, r)
+    if !ok {
+        return
+    }
+    for _, op := range ops {
+        switch {
+        case strings.EqualFold(op.Op, "add") && op.Path == "members":
+            var add []scim.MultiValue
+            if err := json.Unmarshal(op.Value, &add); err != nil {
+                writeError(w, http.StatusBadRequest, "invalidValue", "members must be an array")
+                return
+            }
+            for _, m := range add {
+                if _, ok := s.users[m.Value]; !ok {
+                    writeError(w, http.StatusBadRequest, "invalidValue", "unknown member "+m.Value)
+                    return
+                }
+                if !hasMember(g, m.Value) {
+                    g.Members = append(g.Members, scim.MultiValue{Value: m.Value})
+                }
+            }
+        case strings.EqualFold(op.Op, "remove") && memberPath.MatchString(op.Path):
+            remove := memberPath.FindStringSubmatch(op.Path)[1]
+            kept := g.Members[:0]
+            for _, m := range g.Members {
+                if m.Value != remove {
+                    kept = append(kept, m)
+                }
+            }
+            g.Members = kept
+        default:
+            writeError(w, http.StatusBadRequest, "invalidPath", "unsupported operation")
+            return
+        }
+    }
+    writeJSON(w, http.StatusOK, g)
+}
+
+type rawPatchOp struct {
+    Op    string          `json:"op"`
+    Path  string          `json:"path"`
+    Value json.RawMessage `json:"value"`
+}
+
+func decodePatch(w http.ResponseWriter, r *http.Request) ([]rawPatchOp, bool) {
+    var body struct {
+        Operations []rawPatchOp `json:"Operations"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        writeError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+        return nil, false
+    }
+    return body.Operations, true
+}
+
+func hasMember(g *scim.Group, id string) bool {
+    for _, m := range g.Members {
+        if m.Value == id {
+            return true
+        }
+    }
+    return false
+}
+
+func parseFilter(f string) (attr, value string, ok bool) {
+    m := filterPattern.FindStringSubmatch(strings.TrimSpace(f))
+    if m == nil {
+        return "", "", false
+    }
+    if err := json.Unmarshal([]byte(m[2]), &value); err != nil {
+        return "", "", false
+    }
+    return m[1], value, true
+}
+
+func writeList[T any](w http.ResponseWriter, items []T) {
+    writePage(w, items, len(items), 1)
+}
+
+func writePage[T any](w http.ResponseWriter, items []T, total, start int) {
+    writeJSON(w, http.StatusOK, map[string]any{
+        "schemas":      []string{scim.SchemaList},
+        "totalResults": total,
+        "itemsPerPage": len(items),
+        "startIndex":   start,
+        "Resources":    items,
+    })
+}
+
+func writeError(w http.ResponseWriter, status int, scimType, detail string) {
+    body := map[string]any{"schemas": []string{scim.SchemaError}, "status": fmt.Sprint(status), "detail": detail}
+    if scimType != "" {
+        body["scimType"] = scimType
+    }
+    writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/scim+json")
+    w.WriteHeader(status)
+    _ = json.NewEncoder(w).Encode(v)
+}
+
+func newID() string {
+    b := make([]byte, 16)
+    _, _ = rand.Read(b)
+    return hex.EncodeToString(b)
+}
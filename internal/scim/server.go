@@ -0,0 +1,325 @@
+package scim
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+
+    "smart-transit-system/internal/auth"
+    "smart-transit-system/internal/models"
+)
+
+// Tenant is the organization a SCIM client provisions into and the issuer
+// its staff sign in with. Users it creates belong to that issuer, so a
+// tenant can never create an account that a primary (Asgardeo) login, or
+// another issuer's login, would resolve to.
+type Tenant struct {
+    OrgID  string
+    Issuer string
+}
+
+// ServerConfig configures the inbound SCIM service provider.
+type ServerConfig struct {
+    Tenants     map[string]Tenant // SCIM client id -> its tenant
+    Issuers     []string          // non-primary trusted issuers tenants may be bound to
+    DefaultRole string            // org role of provisioned users outside any group; defaults to "member"
+    // BaseURL is the external scheme://host[:port] clients call; resource
+    // locations are built on it, never on Host or X-Forwarded-* headers.
+    BaseURL string
+}
+
+// Server exposes /Users and /Groups for enterprise customers (bus companies
+// with their own IdP) to provision staff. Each SCIM client is bound to one
+// organization: Users are the org's members and Groups are its member roles.
+type Server struct {
+    db          *gorm.DB
+    rev         *auth.Revocations // optional; applies deactivation immediately
+    tenants     map[string]Tenant
+    defaultRole string
+    baseURL     string
+}
+
+const (
+    contextTenantKey       = "scimOrgID"
+    contextTenantIssuerKey = "scimIssuer"
+    contextBaseURLKey      = "scimBaseURL"
+)
+
+const (
+    maxPageSize     = 200
+    defaultPageSize = 100
+)
+
+var rolePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,31}$`)
+
+// NewServer returns a SCIM server. rev may be nil.
+func NewServer(db *gorm.DB, rev *auth.Revocations, cfg ServerConfig) (*Server, error) {
+    if len(cfg.Tenants) == 0 {
+        return nil, errors.New("no SCIM tenants configured")
+    }
+    if cfg.DefaultRole == "" {
+        cfg.DefaultRole = "member"
+    }
+    if !rolePattern.MatchString(cfg.DefaultRole) {
+        return nil, fmt.Errorf("invalid default role %q", cfg.DefaultRole)
+    }
+    cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+    u, err := url.Parse(cfg.BaseURL)
+    if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Path != "" {
+        return nil, fmt.Errorf("public base URL %q must be scheme://host[:port]", cfg.BaseURL)
+    }
+    trusted := map[string]bool{}
+    for _, iss := range cfg.Issuers {
+        trusted[strings.TrimRight(iss, "/")] = true
+    }
+    for client, t := range cfg.Tenants {
+        if !trusted[t.Issuer] {
+            return nil, fmt.Errorf("tenant %s: issuer %q is not a trusted non-primary issuer", client, t.Issuer)
+        }
+    }
+    return &Server{db: db, rev: rev, tenants: cfg.Tenants, defaultRole: cfg.DefaultRole, baseURL: cfg.BaseURL}, nil
+}
+
+// ParseTenants parses SCIM_TENANTS ("client-id=org-id@issuer,...").
+func ParseTenants(raw string) (map[string]Tenant, error) {
+    out := map[string]Tenant{}
+    for _, pair := range strings.Split(raw, ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        client, rest, ok := strings.Cut(pair, "=")
+        org, issuer, hasIssuer := strings.Cut(rest, "@")
+        client, org, issuer = strings.TrimSpace(client), strings.TrimSpace(org), strings.TrimRight(strings.TrimSpace(issuer), "/")
+        if !ok || !hasIssuer || client == "" || org == "" || issuer == "" {
+            return nil, fmt.Errorf("scim tenants: %q is not client-id=org-id@issuer", pair)
+        }
+        out[client] = Tenant{OrgID: org, Issuer: issuer}
+    }
+    return out, nil
+}
+
+// Register mounts the SCIM endpoints on g, which must already authenticate
+// the caller (auth Middleware plus the SCIM scope).
+func (s *Server) Register(g *gin.RouterGroup) {
+    g = g.Group("", func(c *gin.Context) { c.Set(contextBaseURLKey, s.baseURL) })
+    g.GET("/ServiceProviderConfig", serviceProviderConfig)
+    g.GET("/ResourceTypes", resourceTypes)
+    g.GET("/ResourceTypes/:id", resourceTypes)
+    g.GET("/Schemas", schemas)
+    g.GET("/Schemas/:id", schemas)
+
+    t := g.Group("", s.tenant())
+    t.GET("/Users", s.listUsers)
+    t.POST("/Users", s.createUser)
+    t.GET("/Users/:id", s.getUser)
+    t.PUT("/Users/:id", s.replaceUser)
+    t.PATCH("/Users/:id", s.patchUser)
+    t.DELETE("/Users/:id", s.deleteUser)
+    t.GET("/Groups", s.listGroups)
+    t.POST("/Groups", s.createGroup)
+    t.GET("/Groups/:id", s.getGroup)
+    t.PUT("/Groups/:id", s.replaceGroup)
+    t.PATCH("/Groups/:id", s.patchGroup)
+    t.DELETE("/Groups/:id", s.deleteGroup)
+}
+
+// tenant resolves the caller's client id to its organization. Only service
+// (client-credentials) tokens of configured clients, issued by the primary
+// issuer, are accepted: other issuers do not own our client ids.
+func (s *Server) tenant() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        p, ok := auth.PrincipalFromContext(c)
+        if !ok || !p.IsService() || p.Issuer != "" {
+            writeError(c, http.StatusForbidden, "", "SCIM requires a client-credentials token")
+            return
+        }
+        t, ok := s.tenants[p.ClientID]
+        if !ok {
+            writeError(c, http.StatusForbidden, "", "client is not a SCIM tenant")
+            return
+        }
+        var org models.Organization
+        if err := s.db.WithContext(c.Request.Context()).First(&org, "id = ?", t.OrgID).Error; err != nil {
+            writeError(c, http.StatusForbidden, "", "tenant organization not found")
+            return
+        }
+        if org.Status == models.OrgStatusArchived {
+            writeError(c, http.StatusForbidden, "", "tenant organization is archived")
+            return
+        }
+        c.Set(contextTenantKey, org.ID)
+        c.Set(contextTenantIssuerKey, t.Issuer)
+        c.Next()
+    }
+}
+
+func tenantOrg(c *gin.Context) string { return c.GetString(contextTenantKey) }
+
+func tenantIssuer(c *gin.Context) string { return c.GetString(contextTenantIssuerKey) }
+
+func clientID(c *gin.Context) string {
+    if p, ok := auth.PrincipalFromContext(c); ok {
+        return p.ClientID
+    }
+    return ""
+}
+
+// writeSCIM sends a SCIM JSON response.
+func writeSCIM(c *gin.Context, status int, v any) {
+    c.Header("Content-Type", contentTypeSCIM+"; charset=utf-8")
+    c.JSON(status, v)
+}
+
+// writeError sends a SCIM error (RFC 7644 §3.12) and aborts.
+func writeError(c *gin.Context, status int, scimType, detail string) {
+    body := gin.H{"schemas": []string{SchemaError}, "status": strconv.Itoa(status), "detail": detail}
+    if scimType != "" {
+        body["scimType"] = scimType
+    }
+    c.Header("Content-Type", contentTypeSCIM+"; charset=utf-8")
+    c.AbortWithStatusJSON(status, body)
+}
+
+// writeList sends a ListResponse page.
+func writeList[T any](c *gin.Context, items []T, total int64, start int) {
+    writeSCIM(c, http.StatusOK, gin.H{
+        "schemas":      []string{SchemaList},
+        "totalResults": total,
+        "startIndex":   start,
+        "itemsPerPage": len(items),
+        "Resources":    items,
+    })
+}
+
+// decode reads a JSON request body.
+func decode(c *gin.Context, v any) bool {
+    if err := json.NewDecoder(c.Request.Body).Decode(v); err != nil {
+        writeError(c, http.StatusBadRequest, "invalidSyntax", "invalid JSON body: "+err.Error())
+        return false
+    }
+    return true
+}
+
+// page reads startIndex (1-based) and count.
+func page(c *gin.Context) (start, count int) {
+    start, _ = strconv.Atoi(c.Query("startIndex"))
+    if start < 1 {
+        start = 1
+    }
+    count = defaultPageSize
+    if v := c.Query("count"); v != "" {
+        count, _ = strconv.Atoi(v)
+    }
+    if count < 0 {
+        count = 0
+    }
+    if count > maxPageSize {
+        count = maxPageSize
+    }
+    return start, count
+}
+
+var eqFilter = regexp.MustCompile(`(?i)^\s*([a-z][a-z0-9._]*)\s+eq\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+// parseFilter supports the single-attribute form `attr eq "value"`; allowed
+// lists the (lower-case) attributes that may be filtered on.
+func parseFilter(c *gin.Context, allowed ...string) (attr, value string, ok bool) {
+    f := c.Query("filter")
+    if f == "" {
+        return "", "", true
+    }
+    m := eqFilter.FindStringSubmatch(f)
+    if m == nil {
+        writeError(c, http.StatusBadRequest, "invalidFilter", `only filters of the form attr eq "value" are supported`)
+        return "", "", false
+    }
+    attr = strings.ToLower(m[1])
+    for _, a := range allowed {
+        if attr == a {
+            if err := json.Unmarshal([]byte(`"`+m[2]+`"`), &value); err != nil {
+                writeError(c, http.StatusBadRequest, "invalidFilter", "invalid filter value")
+                return "", "", false
+            }
+            return attr, value, true
+        }
+    }
+    writeError(c, http.StatusBadRequest, "invalidFilter", "filtering on "+m[1]+" is not supported")
+    return "", "", false
+}
+
+// checkIfMatch enforces If-Match against the resource's current version
+// using strong comparison, so weak (W/) tags never match.
+func checkIfMatch(c *gin.Context, version string) bool {
+    want := c.GetHeader("If-Match")
+    if want == "" || want == "*" {
+        return true
+    }
+    for _, v := range strings.Split(want, ",") {
+        if strings.TrimSpace(v) == version {
+            return true
+        }
+    }
+    c.Header("ETag", version)
+    writeError(c, http.StatusPreconditionFailed, "", "resource was modified")
+    return false
+}
+
+// location builds the absolute URL of a resource under this server, on
+// the configured public base URL.
+func location(c *gin.Context, resource, id string) string {
+    base := c.FullPath()
+    for _, r := range []string{"/Users", "/Groups", "/ServiceProviderConfig", "/ResourceTypes", "/Schemas"} {
+        if i := strings.Index(base, r); i >= 0 {
+            base = base[:i]
+        }
+    }
+    u := c.GetString(contextBaseURLKey) + base + "/" + resource
+    if id != "" {
+        u += "/" + id
+    }
+    return u
+}
+
+// patchRequest is the body of a PATCH (RFC 7644 §3.5.2).
+type patchRequest struct {
+    Schemas    []string `json:"schemas"`
+    Operations []struct {
+        Op    string          `json:"op"`
+        Path  string          `json:"path"`
+        Value json.RawMessage `json:"value"`
+    } `json:"Operations"`
+}
+
+// boolValue accepts JSON booleans and the "True"/"False" strings some IdPs send.
+func boolValue(raw json.RawMessage) (bool, error) {
+    var b bool
+    if err := json.Unmarshal(raw, &b); err == nil {
+        return b, nil
+    }
+    var s string
+    if err := json.Unmarshal(raw, &s); err != nil {
+        return false, errors.New("expected a boolean")
+    }
+    return strconv.ParseBool(s)
+}
+
+// stringValue accepts a JSON string (null clears).
+func stringValue(raw json.RawMessage) (string, error) {
+    if len(raw) == 0 || string(raw) == "null" {
+        return "", nil
+    }
+    var s string
+    if err := json.Unmarshal(raw, &s); err != nil {
+        return "", errors.New("expected a string")
+    }
+    return strings.TrimSpace(s), nil
+}
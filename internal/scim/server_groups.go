@@ -0,0 +1,382 @@
+package scim
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "regexp"
+    "sort"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+
+    "smart-transit-system/internal/audit"
+    "smart-transit-system/internal/models"
+)
+
+// Groups are the member roles of the tenant org: the group id and
+// displayName are the role name, and members are the users holding it. A
+// group exists implicitly for every valid role name. Since a user has one
+// role per org, adding a user to a group moves them out of their previous
+// one, and removing a user from a group resets them to the default role.
+
+type groupMember struct {
+    UserID   string
+    UserName string
+    Email    string
+}
+
+// errUnknownMember rejects member ids that are not users of the tenant.
+var errUnknownMember = errors.New("unknown member")
+
+func normalizeRole(displayName string) (string, error) {
+    r := strings.ToLower(strings.TrimSpace(displayName))
+    r = strings.NewReplacer(" ", "_", "-", "_").Replace(r)
+    if !rolePattern.MatchString(r) {
+        return "", fmt.Errorf("displayName %q must map to a role of 2-32 lowercase letters, digits or underscores", displayName)
+    }
+    return r, nil
+}
+
+func (s *Server) roleMembers(c *gin.Context, db *gorm.DB, role string) ([]groupMember, error) {
+    var rows []groupMember
+    err := db.WithContext(c.Request.Context()).
+        Table("user_org_memberships AS m").
+        Select("m.user_id AS user_id, u.user_name AS user_name, u.email AS email").
+        Joins("JOIN users AS u ON u.id = m.user_id").
+        Where("m.org_id = ? AND m.role = ?", tenantOrg(c), role).
+        Order("m.user_id").
+        Scan(&rows).Error
+    return rows, err
+}
+
+func groupVersion(role string, members []groupMember) string {
+    h := sha256.New()
+    h.Write([]byte(role))
+    for _, m := range members {
+        h.Write([]byte{0})
+        h.Write([]byte(m.UserID))
+    }
+    return `"` + hex.EncodeToString(h.Sum(nil))[:16] + `"`
+}
+
+func (s *Server) groupResource(c *gin.Context, role string, members []groupMember) Group {
+    g := Group{
+        Schemas:     []string{SchemaGroup},
+        ID:          role,
+        DisplayName: role,
+        Meta: &Meta{
+            ResourceType: "Group",
+            Location:     location(c, "Groups", role),
+            Version:      groupVersion(role, members),
+        },
+    }
+    if !strings.Contains(strings.ToLower(c.Query("excludedAttributes")), "members") {
+        g.Members = make([]MultiValue, 0, len(members))
+        for _, m := range members {
+            display := m.UserName
+            if display == "" {
+                display = m.Email
+            }
+            g.Members = append(g.Members, MultiValue{Value: m.UserID, Display: display, Ref: location(c, "Users", m.UserID)})
+        }
+    }
+    return g
+}
+
+// findGroup loads the :id group; it writes 404 for ids that are not role names.
+func (s *Server) findGroup(c *gin.Context) (string, []groupMember, bool) {
+    role := c.Param("id")
+    if !rolePattern.MatchString(role) {
+        writeError(c, http.StatusNotFound, "", "group not found")
+        return "", nil, false
+    }
+    members, err := s.roleMembers(c, s.db, role)
+    if err != nil {
+        writeError(c, http.StatusInternalServerError, "", "lookup failed")
+        return "", nil, false
+    }
+    return role, members, true
+}
+
+func (s *Server) listGroups(c *gin.Context) {
+    attr, value, ok := parseFilter(c, "displayname")
+    if !ok {
+        return
+    }
+    var roles []string
+    if attr == "displayname" {
+        // An empty (implicit) group is not listed, so clients create it.
+        if role, err := normalizeRole(value); err == nil {
+            roles = []string{role}
+        }
+    } else {
+        err := s.db.WithContext(c.Request.Context()).Model(&models.UserOrgMembership{}).
+            Where("org_id = ?", tenantOrg(c)).Distinct().Order("role").Pluck("role", &roles).Error
+        if err != nil {
+            writeError(c, http.StatusInternalServerError, "", "list failed")
+            return
+        }
+    }
+    items := []Group{}
+    for _, role := range roles {
+        members, err := s.roleMembers(c, s.db, role)
+        if err != nil {
+            writeError(c, http.StatusInternalServerError, "", "list failed")
+            return
+        }
+        if len(members) > 0 {
+            items = append(items, s.groupResource(c, role, members))
+        }
+    }
+    start, count := page(c)
+    total := len(items)
+    from := min(start-1, total)
+    to := min(from+count, total)
+    writeList(c, items[from:to], int64(total), start)
+}
+
+func (s *Server) getGroup(c *gin.Context) {
+    role, members, ok := s.findGroup(c)
+    if !ok {
+        return
+    }
+    g := s.groupResource(c, role, members)
+    c.Header("ETag", g.Meta.Version)
+    writeSCIM(c, http.StatusOK, g)
+}
+
+func (s *Server) createGroup(c *gin.Context) {
+    var in Group
+    if !decode(c, &in) {
+        return
+    }
+    role, err := normalizeRole(in.DisplayName)
+    if err != nil {
+        writeError(c, http.StatusBadRequest, "invalidValue", err.Error())
+        return
+    }
+    current, err := s.roleMembers(c, s.db, role)
+    if err != nil {
+        writeError(c, http.StatusInternalServerError, "", "create failed")
+        return
+    }
+    if len(current) > 0 {
+        writeError(c, http.StatusConflict, "uniqueness", "group already exists")
+        return
+    }
+    s.updateGroup(c, role, role, nil, memberIDs(in.Members), http.StatusCreated)
+}
+
+func (s *Server) replaceGroup(c *gin.Context) {
+    role, members, ok := s.findGroup(c)
+    if !ok || !checkIfMatch(c, groupVersion(role, members)) {
+        return
+    }
+    var in Group
+    if !decode(c, &in) {
+        return
+    }
+    next := role
+    if in.DisplayName != "" {
+        var err error
+        if next, err = normalizeRole(in.DisplayName); err != nil {
+            writeError(c, http.StatusBadRequest, "invalidValue", err.Error())
+            return
+        }
+    }
+    s.updateGroup(c, role, next, members, memberIDs(in.Members), http.StatusOK)
+}
+
+func (s *Server) patchGroup(c *gin.Context) {
+    role, members, ok := s.findGroup(c)
+    if !ok || !checkIfMatch(c, groupVersion(role, members)) {
+        return
+    }
+    var req patchRequest
+    if !decode(c, &req) {
+        return
+    }
+    next := role
+    want := map[string]bool{}
+    for _, m := range members {
+        want[m.UserID] = true
+    }
+    for _, op := range req.Operations {
+        var err error
+        if next, err = applyGroupOp(want, next, op.Op, op.Path, op.Value); err != nil {
+            writeError(c, http.StatusBadRequest, "invalidValue", err.Error())
+            return
+        }
+    }
+    ids := make([]string, 0, len(want))
+    for id := range want {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    s.updateGroup(c, role, next, members, ids, http.StatusOK)
+}
+
+// deleteGroup resets every member of the role to the default role.
+func (s *Server) deleteGroup(c *gin.Context) {
+    role, members, ok := s.findGroup(c)
+    if !ok || !checkIfMatch(c, groupVersion(role, members)) {
+        return
+    }
+    if err := s.setRoles(c, members, nil, role, role); err != nil {
+        writeError(c, http.StatusInternalServerError, "", "delete failed")
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
+
+// updateGroup makes want the members of role next (renaming from role) and
+// responds with the resulting group.
+func (s *Server) updateGroup(c *gin.Context, role, next string, current []groupMember, want []string, status int) {
+    err := s.setRoles(c, current, want, role, next)
+    if errors.Is(err, errUnknownMember) {
+        writeError(c, http.StatusBadRequest, "invalidValue", err.Error())
+        return
+    }
+    if err != nil {
+        writeError(c, http.StatusInternalServerError, "", "update failed")
+        return
+    }
+    members, err := s.roleMembers(c, s.db, next)
+    if err != nil {
+        writeError(c, http.StatusInternalServerError, "", "reload failed")
+        return
+    }
+    g := s.groupResource(c, next, members)
+    c.Header("ETag", g.Meta.Version)
+    if status == http.StatusCreated {
+        c.Header("Location", g.Meta.Location)
+    }
+    writeSCIM(c, status, g)
+}
+
+// setRoles moves the users in want to role next and resets current members
+// of role that are not in want to the default role, in one transaction.
+func (s *Server) setRoles(c *gin.Context, current []groupMember, want []string, role, next string) error {
+    ctx := c.Request.Context()
+    orgID := tenantOrg(c)
+    keep := map[string]bool{}
+    for _, id := range want {
+        keep[id] = true
+    }
+    type change struct{ userID, from, to string }
+    var changes []change
+    err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+        for _, m := range current {
+            if keep[m.UserID] || role == s.defaultRole {
+                continue
+            }
+            if err := tx.Model(&models.UserOrgMembership{}).
+                Where("user_id = ? AND org_id = ?", m.UserID, orgID).
+                Update("role", s.defaultRole).Error; err != nil {
+                return err
+            }
+            changes = append(changes, change{m.UserID, role, s.defaultRole})
+        }
+        for _, id := range want {
+            if !uuidPattern.MatchString(id) {
+                return fmt.Errorf("%w %s", errUnknownMember, id)
+            }
+            var ms models.UserOrgMembership
+            err := tx.Where("user_id = ? AND org_id = ?", id, orgID).First(&ms).Error
+            if errors.Is(err, gorm.ErrRecordNotFound) {
+                return fmt.Errorf("%w %s", errUnknownMember, id)
+            }
+            if err != nil {
+                return err
+            }
+            if ms.Role == next {
+                continue
+            }
+            if err := tx.Model(&ms).Update("role", next).Error; err != nil {
+                return err
+            }
+            changes = append(changes, change{id, ms.Role, next})
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    for _, ch := range changes {
+        audit.Write(s.db.WithContext(ctx), ch.userID, "", "scim_role_changed", gin.H{"client_id": clientID(c), "org_id": orgID, "from": ch.from, "to": ch.to})
+    }
+    return nil
+}
+
+var memberFilterPath = regexp.MustCompile(`(?i)^members\[value eq "([^"]+)"\]$`)
+
+// applyGroupOp applies one PATCH operation to the wanted member set and
+// returns the (possibly renamed) role.
+func applyGroupOp(want map[string]bool, role, op, path string, value json.RawMessage) (string, error) {
+    op = strings.ToLower(op)
+    p := strings.ToLower(path)
+    switch {
+    case op == "remove" && memberFilterPath.MatchString(path):
+        delete(want, memberFilterPath.FindStringSubmatch(path)[1])
+    case p == "members":
+        var values []MultiValue
+        if len(value) > 0 && string(value) != "null" {
+            if err := json.Unmarshal(value, &values); err != nil {
+                return role, errors.New("members must be an array")
+            }
+        }
+        switch op {
+        case "add":
+            for _, v := range values {
+                want[v.Value] = true
+            }
+        case "replace":
+            clear(want)
+            for _, v := range values {
+                want[v.Value] = true
+            }
+        case "remove":
+            if len(values) == 0 {
+                clear(want)
+            }
+            for _, v := range values {
+                delete(want, v.Value)
+            }
+        default:
+            return role, fmt.Errorf("unsupported op %q", op)
+        }
+    case p == "displayname" && (op == "add" || op == "replace"):
+        name, err := stringValue(value)
+        if err != nil {
+            return role, err
+        }
+        return normalizeRole(name)
+    case p == "" && (op == "add" || op == "replace"):
+        var attrs map[string]json.RawMessage
+        if err := json.Unmarshal(value, &attrs); err != nil {
+            return role, errors.New("value must be an object when path is omitted")
+        }
+        for k, v := range attrs {
+            var err error
+            if role, err = applyGroupOp(want, role, op, k, v); err != nil {
+                return role, err
+            }
+        }
+    case op != "add" && op != "replace" && op != "remove":
+        return role, fmt.Errorf("unsupported op %q", op)
+    }
+    return role, nil
+}
+
+func memberIDs(values []MultiValue) []string {
+    out := make([]string, 0, len(values))
+    for _, v := range values {
+        out = append(out, v.Value)
+    }
+    return out
+}
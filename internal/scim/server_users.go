@@ -0,0 +1,561 @@
+package scim
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+
+    "smart-transit-system/internal/audit"
+    "smart-transit-system/internal/models"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// member is a tenant user with their role in the tenant org.
+type member struct {
+    models.User
+    Role string
+}
+
+// userAttrs are the User attributes stored locally; everything else a
+// client sends is accepted and ignored.
+type userAttrs struct {
+    UserName   string
+    ExternalID string
+    GivenName  string
+    FamilyName string
+    Email      string
+    Phone      string
+    Active     bool
+}
+
+const maxAttrLen = 256
+
+func (a *userAttrs) validate() error {
+    if a.UserName == "" {
+        return errors.New("userName is required")
+    }
+    for _, v := range []string{a.UserName, a.ExternalID, a.GivenName, a.FamilyName, a.Email, a.Phone} {
+        if len(v) > maxAttrLen {
+            return fmt.Errorf("attribute values are limited to %d characters", maxAttrLen)
+        }
+    }
+    return nil
+}
+
+func attrsFromModel(u *models.User) userAttrs {
+    userName := u.UserName
+    if userName == "" {
+        userName = u.Email
+    }
+    return userAttrs{
+        UserName:   userName,
+        ExternalID: u.ExternalID,
+        GivenName:  u.FirstName,
+        FamilyName: u.LastName,
+        Email:      u.Email,
+        Phone:      u.Phone,
+        Active:     u.Status == "" || u.Status == models.UserStatusActive,
+    }
+}
+
+func attrsFromResource(in *User) userAttrs {
+    a := userAttrs{
+        UserName:   strings.TrimSpace(in.UserName),
+        ExternalID: strings.TrimSpace(in.ExternalID),
+        Email:      pickValue(in.Emails, "work"),
+        Phone:      pickValue(in.PhoneNumbers, "mobile"),
+        Active:     in.Active == nil || *in.Active,
+    }
+    if in.Name != nil {
+        a.GivenName, a.FamilyName = strings.TrimSpace(in.Name.GivenName), strings.TrimSpace(in.Name.FamilyName)
+    }
+    return a
+}
+
+// pickValue returns the primary entry, else the first of the preferred
+// type, else the first entry.
+func pickValue(values []MultiValue, preferred string) string {
+    for _, v := range values {
+        if v.Primary {
+            return strings.TrimSpace(v.Value)
+        }
+    }
+    for _, v := range values {
+        if strings.EqualFold(v.Type, preferred) {
+            return strings.TrimSpace(v.Value)
+        }
+    }
+    if len(values) > 0 {
+        return strings.TrimSpace(values[0].Value)
+    }
+    return ""
+}
+
+func userVersion(u *models.User) string {
+    return fmt.Sprintf(`"%d"`, u.UpdatedAt.UnixMicro())
+}
+
+func userStatus(active bool) string {
+    if active {
+        return models.UserStatusActive
+    }
+    return models.UserStatusInactive
+}
+
+func (s *Server) userResource(c *gin.Context, m *member) User {
+    a := attrsFromModel(&m.User)
+    u := User{
+        Schemas:    []string{SchemaUser},
+        ID:         m.ID,
+        ExternalID: a.ExternalID,
+        UserName:   a.UserName,
+        Active:     &a.Active,
+        Groups:     []MultiValue{{Value: m.Role, Display: m.Role, Ref: location(c, "Groups", m.Role)}},
+        Meta: &Meta{
+            ResourceType: "User",
+            Created:      &m.CreatedAt,
+            LastModified: &m.UpdatedAt,
+            Location:     location(c, "Users", m.ID),
+            Version:      userVersion(&m.User),
+        },
+    }
+    if a.GivenName != "" || a.FamilyName != "" {
+        u.Name = &Name{GivenName: a.GivenName, FamilyName: a.FamilyName}
+    }
+    if a.Email != "" {
+        u.Emails = []MultiValue{{Value: a.Email, Type: "work", Primary: true}}
+    }
+    if a.Phone != "" {
+        u.PhoneNumbers = []MultiValue{{Value: a.Phone, Type: "mobile"}}
+    }
+    return u
+}
+
+// tenantUsers selects users that are members of the tenant org, with their role.
+func (s *Server) tenantUsers(c *gin.Context) *gorm.DB {
+    return s.db.WithContext(c.Request.Context()).
+        Table("users").
+        Joins("JOIN user_org_memberships AS m ON m.user_id = users.id AND m.org_id = ?", tenantOrg(c))
+}
+
+// findUser loads the :id user if it belongs to the tenant; it writes 404
+// otherwise.
+func (s *Server) findUser(c *gin.Context) (*member, bool) {
+    id := c.Param("id")
+    var rows []member
+    if uuidPattern.MatchString(id) {
+        if err := s.tenantUsers(c).Select("users.*, m.role AS role").Where("users.id = ?", id).Limit(1).Scan(&rows).Error; err != nil {
+            writeError(c, http.StatusInternalServerError, "", "lookup failed")
+            return nil, false
+        }
+    }
+    if len(rows) == 0 {
+        writeError(c, http.StatusNotFound, "", "user not found")
+        return nil, false
+    }
+    return &rows[0], true
+}
+
+func (s *Server) listUsers(c *gin.Context) {
+    attr, value, ok := parseFilter(c, "username", "externalid")
+    if !ok {
+        return
+    }
+    q := s.tenantUsers(c)
+    switch attr {
+    case "username":
+        q = q.Where("LOWER(users.user_name) = LOWER(?)", value)
+    case "externalid":
+        q = q.Where("users.external_id = ?", value)
+    }
+    var total int64
+    if err := q.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+        writeError(c, http.StatusInternalServerError, "", "list failed")
+        return
+    }
+    start, count := page(c)
+    var rows []member
+    if count > 0 {
+        err := q.Select("users.*, m.role AS role").Order("users.created_at, users.id").Offset(start - 1).Limit(count).Scan(&rows).Error
+        if err != nil {
+            writeError(c, http.StatusInternalServerError, "", "list failed")
+            return
+        }
+    }
+    items := make([]User, 0, len(rows))
+    for i := range rows {
+        items = append(items, s.userResource(c, &rows[i]))
+    }
+    writeList(c, items, total, start)
+}
+
+func (s *Server) getUser(c *gin.Context) {
+    m, ok := s.findUser(c)
+    if !ok {
+        return
+    }
+    c.Header("ETag", userVersion(&m.User))
+    writeSCIM(c, http.StatusOK, s.userResource(c, m))
+}
+
+// createUser provisions a user into the tenant org with the default role.
+// The user belongs to the tenant's issuer and the token subject is taken
+// from externalId (falling back to userName), so the customer's IdP must
+// send its OIDC sub as externalId for the user's first login to match this
+// row. userName is unique within the tenant.
+func (s *Server) createUser(c *gin.Context) {
+    var in User
+    if !decode(c, &in) {
+        return
+    }
+    a := attrsFromResource(&in)
+    if err := a.validate(); err != nil {
+        writeError(c, http.StatusBadRequest, "invalidValue", err.Error())
+        return
+    }
+    sub := a.ExternalID
+    if sub == "" {
+        sub = a.UserName
+    }
+    ctx := c.Request.Context()
+    orgID := tenantOrg(c)
+    issuer := tenantIssuer(c)
+    m := member{Role: s.defaultRole, User: models.User{
+        Issuer:     issuer,
+        Sub:        sub,
+        UserName:   a.UserName,
+        ExternalID: a.ExternalID,
+        Email:      a.Email,
+        FirstName:  a.GivenName,
+        LastName:   a.FamilyName,
+        Phone:      a.Phone,
+        Status:     userStatus(a.Active),
+    }}
+    conflict := false
+    err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+        var n int64
+        err := tx.Model(&models.User{}).
+            Where("issuer = ? AND sub = ?", issuer, sub).
+            Or("LOWER(user_name) = LOWER(?) AND EXISTS (SELECT 1 FROM user_org_memberships AS m WHERE m.user_id = users.id AND m.org_id = ?)", a.UserName, orgID).
+            Count(&n).Error
+        if err != nil {
+            return err
+        }
+        if n > 0 {
+            conflict = true
+            return nil
+        }
+        if err := tx.Create(&m.User).Error; err != nil {
+            return err
+        }
+        return tx.Create(&models.UserOrgMembership{UserID: m.ID, OrgID: orgID, Role: m.Role}).Error
+    })
+    if err != nil {
+        writeError(c, http.StatusInternalServerError, "", "create failed")
+        return
+    }
+    if conflict {
+        writeError(c, http.StatusConflict, "uniqueness", "a user with this userName or externalId already exists")
+        return
+    }
+    audit.Write(s.db.WithContext(ctx), m.ID, "", "scim_provisioned", gin.H{"client_id": clientID(c), "org_id": orgID, "issuer": issuer, "user_name": a.UserName})
+    res := s.userResource(c, &m)
+    c.Header("Location", res.Meta.Location)
+    c.Header("ETag", res.Meta.Version)
+    writeSCIM(c, http.StatusCreated, res)
+}
+
+func (s *Server) replaceUser(c *gin.Context) {
+    m, ok := s.findUser(c)
+    if !ok || !checkIfMatch(c, userVersion(&m.User)) {
+        return
+    }
+    var in User
+    if !decode(c, &in) {
+        return
+    }
+    s.saveUser(c, m, attrsFromResource(&in))
+}
+
+func (s *Server) patchUser(c *gin.Context) {
+    m, ok := s.findUser(c)
+    if !ok || !checkIfMatch(c, userVersion(&m.User)) {
+        return
+    }
+    var req patchRequest
+    if !decode(c, &req) {
+        return
+    }
+    a := attrsFromModel(&m.User)
+    for _, op := range req.Operations {
+        if err := applyUserOp(&a, op.Op, op.Path, op.Value); err != nil {
+            writeError(c, http.StatusBadRequest, "invalidValue", err.Error())
+            return
+        }
+    }
+    s.saveUser(c, m, a)
+}
+
+// saveUser writes changed attributes with an optimistic check on
+// updated_at and responds with the updated resource. The users row is
+// global, so only users whose sole membership is the tenant org are
+// changed; for users also in other orgs, active=false removes them from
+// the tenant org and other changes are ignored.
+func (s *Server) saveUser(c *gin.Context, m *member, a userAttrs) {
+    if err := a.validate(); err != nil {
+        writeError(c, http.StatusBadRequest, "invalidValue", err.Error())
+        return
+    }
+    ctx := c.Request.Context()
+    orgID := tenantOrg(c)
+    var others int64
+    if err := s.db.WithContext(ctx).Model(&models.UserOrgMembership{}).Where("user_id = ? AND org_id <> ?", m.ID, orgID).Count(&others).Error; err != nil {
+        writeError(c, http.StatusInternalServerError, "", "update failed")
+        return
+    }
+    if others > 0 {
+        s.saveSharedUser(c, m, a)
+        return
+    }
+    cur := attrsFromModel(&m.User)
+    changes := map[string]any{}
+    diff := map[string]any{}
+    set := func(col, from, to string) {
+        if from != to {
+            changes[col] = to
+            diff[col] = map[string]string{"from": from, "to": to}
+        }
+    }
+    set("user_name", cur.UserName, a.UserName)
+    set("external_id", cur.ExternalID, a.ExternalID)
+    set("first_name", cur.GivenName, a.GivenName)
+    set("last_name", cur.FamilyName, a.FamilyName)
+    set("email", cur.Email, a.Email)
+    set("phone", cur.Phone, a.Phone)
+    if cur.Active != a.Active {
+        set("status", m.Status, userStatus(a.Active))
+    }
+    // Until the first login (which records synced_claims) the subject follows
+    // externalId, falling back to userName, as on create. Afterwards the row
+    // is tied to a real account and externalId can no longer change.
+    sub := a.ExternalID
+    if sub == "" {
+        sub = a.UserName
+    }
+    if sub != m.Sub {
+        switch {
+        case m.SyncedClaims == "":
+            set("sub", m.Sub, sub)
+        case a.ExternalID != cur.ExternalID:
+            writeError(c, http.StatusBadRequest, "mutability", "externalId cannot change after the user has signed in")
+            return
+        }
+    }
+    if len(changes) > 0 {
+        if _, ok := changes["sub"]; ok {
+            var n int64
+            err := s.db.WithContext(ctx).Model(&models.User{}).
+                Where("issuer = ? AND sub = ? AND id <> ?", m.Issuer, sub, m.ID).Count(&n).Error
+            if err != nil {
+                writeError(c, http.StatusInternalServerError, "", "update failed")
+                return
+            }
+            if n > 0 {
+                writeError(c, http.StatusConflict, "uniqueness", "a user with this externalId already exists")
+                return
+            }
+        }
+        if _, ok := changes["user_name"]; ok {
+            var n int64
+            err := s.tenantUsers(c).
+                Where("users.id <> ? AND LOWER(users.user_name) = LOWER(?)", m.ID, a.UserName).Count(&n).Error
+            if err != nil {
+                writeError(c, http.StatusInternalServerError, "", "update failed")
+                return
+            }
+            if n > 0 {
+                writeError(c, http.StatusConflict, "uniqueness", "userName is already taken")
+                return
+            }
+        }
+        changes["updated_at"] = time.Now()
+        // Also guarded on the membership check above: a user who joined
+        // another org meanwhile is left alone and the client retries.
+        res := s.db.WithContext(ctx).Model(&models.User{}).
+            Where("id = ? AND updated_at = ?", m.ID, m.UpdatedAt).
+            Where("NOT EXISTS (SELECT 1 FROM user_org_memberships AS o WHERE o.user_id = users.id AND o.org_id <> ?)", orgID).
+            Updates(changes)
+        if res.Error != nil {
+            writeError(c, http.StatusInternalServerError, "", "update failed")
+            return
+        }
+        if res.RowsAffected == 0 {
+            writeError(c, http.StatusPreconditionFailed, "", "resource was modified")
+            return
+        }
+        if status, ok := changes["status"].(string); ok && s.rev != nil {
+            if v, ok := changes["sub"].(string); ok {
+                m.Sub = v
+            }
+            s.rev.SetUserStatus(m.Issuer, m.Sub, status)
+        }
+        audit.Write(s.db.WithContext(ctx), m.ID, "", "scim_user_updated", gin.H{"client_id": clientID(c), "changes": diff})
+        if err := s.db.WithContext(ctx).First(&m.User, "id = ?", m.ID).Error; err != nil {
+            writeError(c, http.StatusInternalServerError, "", "reload failed")
+            return
+        }
+    }
+    c.Header("ETag", userVersion(&m.User))
+    writeSCIM(c, http.StatusOK, s.userResource(c, m))
+}
+
+// saveSharedUser handles a replace or patch of a user who is also a member
+// of other orgs. Their profile and status belong to every org, so the
+// tenant can only take them out of its own org: active=false removes the
+// membership, like DELETE. Anything else is accepted and ignored.
+func (s *Server) saveSharedUser(c *gin.Context, m *member, a userAttrs) {
+    if a.Active {
+        c.Header("ETag", userVersion(&m.User))
+        writeSCIM(c, http.StatusOK, s.userResource(c, m))
+        return
+    }
+    ctx := c.Request.Context()
+    orgID := tenantOrg(c)
+    if err := s.db.WithContext(ctx).Where("user_id = ? AND org_id = ?", m.ID, orgID).Delete(&models.UserOrgMembership{}).Error; err != nil {
+        writeError(c, http.StatusInternalServerError, "", "update failed")
+        return
+    }
+    audit.Write(s.db.WithContext(ctx), m.ID, "", "scim_deprovisioned", gin.H{"client_id": clientID(c), "org_id": orgID, "deactivated": false, "shared": true})
+    // The user is no longer the tenant's; report them as inactive.
+    res := s.userResource(c, m)
+    inactive := false
+    res.Active = &inactive
+    writeSCIM(c, http.StatusOK, res)
+}
+
+// deleteUser removes the user from the tenant org. Users left without any
+// org are deactivated; the row stays for audit and other references.
+func (s *Server) deleteUser(c *gin.Context) {
+    m, ok := s.findUser(c)
+    if !ok || !checkIfMatch(c, userVersion(&m.User)) {
+        return
+    }
+    ctx := c.Request.Context()
+    orgID := tenantOrg(c)
+    deactivated := false
+    err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+        if err := tx.Where("user_id = ? AND org_id = ?", m.ID, orgID).Delete(&models.UserOrgMembership{}).Error; err != nil {
+            return err
+        }
+        var others int64
+        if err := tx.Model(&models.UserOrgMembership{}).Where("user_id = ?", m.ID).Count(&others).Error; err != nil {
+            return err
+        }
+        if others > 0 || m.Status == models.UserStatusInactive {
+            return nil
+        }
+        deactivated = true
+        return tx.Model(&m.User).Update("status", models.UserStatusInactive).Error
+    })
+    if err != nil {
+        writeError(c, http.StatusInternalServerError, "", "delete failed")
+        return
+    }
+    if deactivated && s.rev != nil {
+        s.rev.SetUserStatus(m.Issuer, m.Sub, models.UserStatusInactive)
+    }
+    audit.Write(s.db.WithContext(ctx), m.ID, "", "scim_deprovisioned", gin.H{"client_id": clientID(c), "org_id": orgID, "deactivated": deactivated})
+    c.Status(http.StatusNoContent)
+}
+
+var filteredValuePath = regexp.MustCompile(`^(emails|phonenumbers)\[[^\]]*\]\.value$`)
+
+// applyUserOp applies one PATCH operation to a. Attributes this service does
+// not store are ignored.
+func applyUserOp(a *userAttrs, op, path string, value json.RawMessage) error {
+    switch strings.ToLower(op) {
+    case "add", "replace":
+    case "remove":
+        if path == "" {
+            return errors.New("remove requires a path")
+        }
+        value = nil
+    default:
+        return fmt.Errorf("unsupported op %q", op)
+    }
+    if path != "" {
+        return setUserAttr(a, path, value)
+    }
+    var attrs map[string]json.RawMessage
+    if err := json.Unmarshal(value, &attrs); err != nil {
+        return errors.New("value must be an object when path is omitted")
+    }
+    for k, v := range attrs {
+        if err := setUserAttr(a, k, v); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func setUserAttr(a *userAttrs, path string, v json.RawMessage) error {
+    p := strings.ToLower(path)
+    p = strings.TrimPrefix(p, strings.ToLower(SchemaUser)+":")
+    var err error
+    switch {
+    case p == "username":
+        a.UserName, err = stringValue(v)
+    case p == "externalid":
+        a.ExternalID, err = stringValue(v)
+    case p == "active":
+        if v == nil {
+            return errors.New("active cannot be removed")
+        }
+        a.Active, err = boolValue(v)
+    case p == "name.givenname":
+        a.GivenName, err = stringValue(v)
+    case p == "name.familyname":
+        a.FamilyName, err = stringValue(v)
+    case p == "name":
+        var n Name
+        if v != nil {
+            if err := json.Unmarshal(v, &n); err != nil {
+                return errors.New("name must be an object")
+            }
+        }
+        a.GivenName, a.FamilyName = strings.TrimSpace(n.GivenName), strings.TrimSpace(n.FamilyName)
+    case p == "emails" || p == "phonenumbers":
+        var values []MultiValue
+        if v != nil {
+            if err := json.Unmarshal(v, &values); err != nil {
+                return fmt.Errorf("%s must be an array", path)
+            }
+        }
+        if p == "emails" {
+            a.Email = pickValue(values, "work")
+        } else {
+            a.Phone = pickValue(values, "mobile")
+        }
+    case filteredValuePath.MatchString(p):
+        var s string
+        if s, err = stringValue(v); err == nil {
+            if strings.HasPrefix(p, "emails") {
+                a.Email = s
+            } else {
+                a.Phone = s
+            }
+        }
+    }
+    if err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    }
+    return nil
+}
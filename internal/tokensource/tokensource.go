@@ -0,0 +1,277 @@
+// Package tokensource obtains OAuth2 client-credentials access tokens for
+// outbound calls (SCIM, admin APIs) and keeps them cached until shortly
+// before they expire.
+package tokensource
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    jwt "github.com/golang-jwt/jwt/v4"
+    "golang.org/x/sync/singleflight"
+)
+
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// Config configures a client-credentials token source. Set either
+// ClientSecret (client_secret_basic) or PrivateKeyFile (private_key_jwt).
+type Config struct {
+    TokenURL       string // usually the discovered token_endpoint
+    ClientID       string
+    ClientSecret   string
+    PrivateKeyFile string // PEM (PKCS#1, PKCS#8 or SEC 1) RSA or EC key
+    KeyID          string // kid of the registered public key, optional
+    Scopes         []string
+    Skew           time.Duration // refresh this long before expiry; defaults to 60s
+    HTTPClient     *http.Client  // for token requests; defaults to a 10s timeout client
+}
+
+// Source hands out cached access tokens; it is safe for concurrent use.
+type Source struct {
+    cfg    Config
+    key    crypto.Signer
+    method jwt.SigningMethod
+
+    mu      sync.Mutex
+    token   string
+    expires time.Time
+    fetch   singleflight.Group
+}
+
+// New validates cfg and loads the private key, if any.
+func New(cfg Config) (*Source, error) {
+    if cfg.TokenURL == "" || cfg.ClientID == "" {
+        return nil, errors.New("token url and client id are required")
+    }
+    if (cfg.ClientSecret == "") == (cfg.PrivateKeyFile == "") {
+        return nil, errors.New("set exactly one of client secret or private key")
+    }
+    if cfg.Skew <= 0 {
+        cfg.Skew = 60 * time.Second
+    }
+    if cfg.HTTPClient == nil {
+        cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+    }
+    s := &Source{cfg: cfg}
+    if cfg.PrivateKeyFile != "" {
+        key, err := loadPrivateKey(cfg.PrivateKeyFile)
+        if err != nil {
+            return nil, err
+        }
+        s.key = key
+        switch k := key.(type) {
+        case *rsa.PrivateKey:
+            s.method = jwt.SigningMethodRS256
+        case *ecdsa.PrivateKey:
+            switch k.Curve.Params().BitSize {
+            case 256:
+                s.method = jwt.SigningMethodES256
+            case 384:
+                s.method = jwt.SigningMethodES384
+            default:
+                s.method = jwt.SigningMethodES512
+            }
+        }
+    }
+    return s, nil
+}
+
+// Token returns a valid access token, fetching a new one when the cached
+// token is missing or about to expire. Concurrent callers share one fetch.
+func (s *Source) Token(ctx context.Context) (string, error) {
+    s.mu.Lock()
+    if s.token != "" && time.Until(s.expires) > s.cfg.Skew {
+        tok := s.token
+        s.mu.Unlock()
+        return tok, nil
+    }
+    s.mu.Unlock()
+
+    v, err, _ := s.fetch.Do("token", func() (any, error) {
+        // The caller's context may be cancelled while others wait on this
+        // fetch, so it runs detached with its own timeout.
+        fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 15*time.Second)
+        defer cancel()
+        return s.fetchToken(fctx)
+    })
+    if err != nil {
+        return "", err
+    }
+    return v.(string), nil
+}
+
+// Invalidate drops the cached token, e.g. after the API rejected it.
+func (s *Source) Invalidate() {
+    s.mu.Lock()
+    s.token = ""
+    s.mu.Unlock()
+}
+
+func (s *Source) fetchToken(ctx context.Context) (string, error) {
+    form := url.Values{}
+    form.Set("grant_type", "client_credentials")
+    if len(s.cfg.Scopes) > 0 {
+        form.Set("scope", strings.Join(s.cfg.Scopes, " "))
+    }
+    if s.key != nil {
+        assertion, err := s.clientAssertion()
+        if err != nil {
+            return "", err
+        }
+        form.Set("client_id", s.cfg.ClientID)
+        form.Set("client_assertion_type", clientAssertionType)
+        form.Set("client_assertion", assertion)
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.TokenURL, strings.NewReader(form.Encode()))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    if s.key == nil {
+        req.SetBasicAuth(url.QueryEscape(s.cfg.ClientID), url.QueryEscape(s.cfg.ClientSecret))
+    }
+    resp, err := s.cfg.HTTPClient.Do(req)
+    if err != nil {
+        return "", fmt.Errorf("token endpoint: %w", err)
+    }
+    defer resp.Body.Close()
+    var body struct {
+        AccessToken      string `json:"access_token"`
+        ExpiresIn        int    `json:"expires_in"`
+        Error            string `json:"error"`
+        ErrorDescription string `json:"error_description"`
+    }
+    if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+        return "", fmt.Errorf("decode token response: %w", err)
+    }
+    if resp.StatusCode != http.StatusOK {
+        if body.Error != "" {
+            return "", fmt.Errorf("token endpoint: %s: %s", body.Error, body.ErrorDescription)
+        }
+        return "", fmt.Errorf("token endpoint: status %d", resp.StatusCode)
+    }
+    if body.AccessToken == "" {
+        return "", errors.New("token endpoint: missing access_token")
+    }
+    expiresIn := time.Duration(body.ExpiresIn) * time.Second
+    if expiresIn <= 0 {
+        expiresIn = 5 * time.Minute
+    }
+    s.mu.Lock()
+    s.token, s.expires = body.AccessToken, time.Now().Add(expiresIn)
+    s.mu.Unlock()
+    return body.AccessToken, nil
+}
+
+// clientAssertion signs a private_key_jwt assertion (RFC 7523).
+func (s *Source) clientAssertion() (string, error) {
+    jti := make([]byte, 16)
+    if _, err := rand.Read(jti); err != nil {
+        return "", err
+    }
+    now := time.Now()
+    tok := jwt.NewWithClaims(s.method, jwt.MapClaims{
+        "iss": s.cfg.ClientID,
+        "sub": s.cfg.ClientID,
+        "aud": s.cfg.TokenURL,
+        "jti": base64.RawURLEncoding.EncodeToString(jti),
+        "iat": now.Unix(),
+        "exp": now.Add(5 * time.Minute).Unix(),
+    })
+    if s.cfg.KeyID != "" {
+        tok.Header["kid"] = s.cfg.KeyID
+    }
+    signed, err := tok.SignedString(s.key)
+    if err != nil {
+        return "", fmt.Errorf("sign client assertion: %w", err)
+    }
+    return signed, nil
+}
+
+func loadPrivateKey(path string) (crypto.Signer, error) {
+    b, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("private key: %w", err)
+    }
+    block, _ := pem.Decode(b)
+    if block == nil {
+        return nil, fmt.Errorf("private key %s: no PEM block", path)
+    }
+    if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+        switch k := k.(type) {
+        case *rsa.PrivateKey:
+            return k, nil
+        case *ecdsa.PrivateKey:
+            return k, nil
+        }
+        return nil, fmt.Errorf("private key %s: unsupported key type", path)
+    }
+    if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+        return k, nil
+    }
+    if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+        return k, nil
+    }
+    return nil, fmt.Errorf("private key %s: unsupported format", path)
+}
+
+// Client returns an http.Client that adds the access token to every request
+// and, when the server answers 401, retries once with a fresh token.
+func (s *Source) Client() *http.Client {
+    return &http.Client{
+        Timeout:   30 * time.Second,
+        Transport: &transport{source: s, base: http.DefaultTransport},
+    }
+}
+
+type transport struct {
+    source *Source
+    base   http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+    resp, err := t.send(req)
+    if err != nil || resp.StatusCode != http.StatusUnauthorized {
+        return resp, err
+    }
+    // Retry once if the body can be replayed.
+    if req.Body != nil && req.GetBody == nil {
+        return resp, nil
+    }
+    resp.Body.Close()
+    t.source.Invalidate()
+    retry := req.Clone(req.Context())
+    if req.GetBody != nil {
+        if retry.Body, err = req.GetBody(); err != nil {
+            return nil, err
+        }
+    }
+    return t.send(retry)
+}
+
+func (t *transport) send(req *http.Request) (*http.Response, error) {
+    tok, err := t.source.Token(req.Context())
+    if err != nil {
+        return nil, err
+    }
+    r := req.Clone(req.Context())
+    r.Header.Set("Authorization", "Bearer "+tok)
+    return t.base.RoundTrip(r)
+}
@@ -10,6 +10,11 @@ CREATE TABLE IF NOT EXISTS users (
     first_name TEXT,
     last_name TEXT,
     status TEXT DEFAULT 'active',
+    synced_claims TEXT,
+    scim_id TEXT,
+    user_name TEXT,
+    external_id TEXT,
+    missing_upstream_at TIMESTAMPTZ,
     created_at TIMESTAMPTZ DEFAULT now(),
     updated_at TIMESTAMPTZ DEFAULT now()
 );
@@ -30,6 +35,7 @@ CREATE TABLE IF NOT EXISTS user_org_memberships (
     role TEXT NOT NULL,
     assigned_at TIMESTAMPTZ DEFAULT now()
 );
+CREATE UNIQUE INDEX IF NOT EXISTS idx_membership_user_org ON user_org_memberships(user_id, org_id);
 
 CREATE TABLE IF NOT EXISTS user_audit (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
@@ -40,3 +46,78 @@ CREATE TABLE IF NOT EXISTS user_audit (
     ts TIMESTAMPTZ DEFAULT now()
 );
 
+-- Server-side sessions for BFF mode (id is the SHA-256 of the cookie value)
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    sub TEXT NOT NULL,
+    s_id TEXT,
+    access_token TEXT NOT NULL,
+    refresh_token TEXT,
+    id_token TEXT,
+    token_expiry TIMESTAMPTZ,
+    csrf_token TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    updated_at TIMESTAMPTZ DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_sub ON sessions(sub);
+CREATE INDEX IF NOT EXISTS idx_sessions_s_id ON sessions(s_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+
+-- Used DPoP proof ids (replay protection shared across replicas)
+CREATE TABLE IF NOT EXISTS dpop_proofs (
+    jti TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_dpop_proofs_expires_at ON dpop_proofs(expires_at);
+
+-- Local token revocations: a jti, all tokens of a sub issued before
+-- revoked_before, or an IdP session id (sid)
+CREATE TABLE IF NOT EXISTS token_revocations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    kind TEXT NOT NULL,
+    value TEXT NOT NULL,
+    revoked_before TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL,
+    reason TEXT,
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_revocation_kind_value ON token_revocations(kind, value);
+CREATE INDEX IF NOT EXISTS idx_token_revocations_expires_at ON token_revocations(expires_at);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS scim_id TEXT;
+CREATE INDEX IF NOT EXISTS idx_users_scim_id ON users(scim_id);
+
+-- Local user/membership changes waiting to be pushed to the IdP over SCIM
+CREATE TABLE IF NOT EXISTS scim_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    op TEXT NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    org_id TEXT,
+    role TEXT,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_error TEXT,
+    failed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_scim_outbox_user_id ON scim_outbox(user_id);
+CREATE INDEX IF NOT EXISTS idx_scim_outbox_next_attempt_at ON scim_outbox(next_attempt_at);
+
+-- Inbound SCIM: userName/externalId sent by customer IdPs
+ALTER TABLE users ADD COLUMN IF NOT EXISTS user_name TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS external_id TEXT;
+CREATE INDEX IF NOT EXISTS idx_users_user_name ON users(user_name);
+CREATE INDEX IF NOT EXISTS idx_users_external_id ON users(external_id);
+
+-- IdP reconciliation: set when Asgardeo no longer lists a linked user
+ALTER TABLE users ADD COLUMN IF NOT EXISTS missing_upstream_at TIMESTAMPTZ;
+
+-- Users are identified by (issuer, sub); '' is the primary issuer
+ALTER TABLE users ADD COLUMN IF NOT EXISTS issuer TEXT NOT NULL DEFAULT '';
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_sub_key;
+DROP INDEX IF EXISTS idx_users_sub;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_issuer_sub ON users(issuer, sub);
+
+-- SCIM outbox: a change claimed by a worker is skipped by others until then
+ALTER TABLE scim_outbox ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ;